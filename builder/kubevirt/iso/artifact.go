@@ -3,8 +3,24 @@
 
 package iso
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 type Artifact struct {
+	// Name is the name of the DataSource of the root disk.
 	Name string
+	// Namespace is the namespace of the published DataSources.
+	Namespace string
+	// BuildName is the name of the temporary VM, unique to the build, from which
+	// the names of its volumes, ConfigMap, Secret and Pods are derived.
+	BuildName string
+	// Disks maps the name of each additional exported disk to the name of its DataSource.
+	Disks map[string]string
+	// TemplateFile is the path of the VirtualMachine manifest written locally, if any.
+	TemplateFile string
 }
 
 func (a *Artifact) BuilderId() string {
@@ -12,7 +28,10 @@ func (a *Artifact) BuilderId() string {
 }
 
 func (a *Artifact) Files() []string {
-	return nil
+	if a.TemplateFile == "" {
+		return nil
+	}
+	return []string{a.TemplateFile}
 }
 
 func (a *Artifact) Id() string {
@@ -20,10 +39,27 @@ func (a *Artifact) Id() string {
 }
 
 func (a *Artifact) String() string {
-	return a.Name
+	if len(a.Disks) == 0 {
+		return a.Name
+	}
+
+	disks := make([]string, 0, len(a.Disks))
+	for disk, name := range a.Disks {
+		disks = append(disks, fmt.Sprintf("%s: %s", disk, name))
+	}
+	sort.Strings(disks)
+	return fmt.Sprintf("%s (%s)", a.Name, strings.Join(disks, ", "))
 }
 
 func (a *Artifact) State(name string) interface{} {
+	switch name {
+	case "disks":
+		return a.Disks
+	case "namespace":
+		return a.Namespace
+	case "build_name":
+		return a.BuildName
+	}
 	return nil
 }
 
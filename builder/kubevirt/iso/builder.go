@@ -11,11 +11,13 @@ import (
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	packerssh "github.com/hashicorp/packer-plugin-sdk/communicator/ssh"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -64,16 +66,40 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 }
 
 func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
+	b.config.buildID = utilrand.String(buildIDLength)
+
+	// The public key can be authorized by the media templates.
+	if b.config.Communicator == "ssh" && b.config.sshKeyPair == nil {
+		keyPair, err := packerssh.NewKeyPair(packerssh.CreateKeyPairConfig{Comment: "packer-" + b.config.buildName()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate the SSH key pair: %w", err)
+		}
+		b.config.sshKeyPair = &keyPair
+	}
+
 	steps := []multistep.Step{}
 	steps = append(steps,
+		&StepPreflightChecks{
+			Config: b.config,
+			Client: b.client,
+		},
+		&StepValidateOutput{
+			Config: b.config,
+			Client: b.client,
+		},
 		&StepValidateIsoDataVolume{
 			Config: b.config,
 			Client: b.client,
 		},
-		&StepCopyMediaFiles{
+		&StepCreateBuildLease{
 			Config: b.config,
 			Client: b.clientset,
 		},
+		&StepCopyMediaFiles{
+			Config:     b.config,
+			Client:     b.clientset,
+			VirtClient: b.client,
+		},
 		&StepCreateVirtualMachine{
 			Config: b.config,
 			Client: b.client,
@@ -105,29 +131,97 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 		steps = append(steps, winRMSteps...)
 	}
 
+	if b.config.Fstrim {
+		steps = append(steps,
+			&StepTrimFilesystems{
+				Config: b.config,
+			},
+		)
+	}
+
+	if b.config.Seal {
+		steps = append(steps,
+			&StepSealVirtualMachine{
+				Config: b.config,
+				Client: b.client,
+			},
+		)
+	}
+
 	steps = append(steps,
 		&StepStopVirtualMachine{
 			Config: b.config,
 			Client: b.client,
 		},
+	)
+
+	if len(b.config.customizeCommands()) > 0 {
+		steps = append(steps,
+			&StepCustomizeDisk{
+				Config: b.config,
+				Client: b.clientset,
+			},
+		)
+	}
+
+	if b.config.shrinkDisk() {
+		steps = append(steps,
+			&StepShrinkDisk{
+				Config:     b.config,
+				Client:     b.clientset,
+				VirtClient: b.client,
+			},
+		)
+	}
+
+	steps = append(steps,
 		&StepCreateBootableVolume{
 			Config: b.config,
 			Client: b.client,
 		},
 	)
 
+	if b.config.VirtualMachineTemplate != nil {
+		steps = append(steps,
+			&StepCreateVirtualMachineTemplate{
+				Config: b.config,
+				Client: b.client,
+			},
+		)
+	}
+
 	state := new(multistep.BasicStateBag)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
+	state.Put("build_name", b.config.buildName())
 
 	b.runner = commonsteps.NewRunner(steps, b.config.PackerConfig, ui)
 	b.runner.Run(ctx, state)
 
+	// The published image is deleted if the build failed after it was created.
+	if err, ok := state.Get("error").(error); ok {
+		return nil, err
+	}
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		return nil, fmt.Errorf("build was cancelled")
+	}
+	if _, ok := state.GetOk(multistep.StateHalted); ok {
+		return nil, fmt.Errorf("build was halted")
+	}
+
 	bootableVolumeName, ok := state.Get("bootable_volume_name").(string)
 	if !ok || bootableVolumeName == "" {
 		return nil, fmt.Errorf("bootable volume name not found in state")
 	}
-	return &Artifact{Name: bootableVolumeName}, nil
+	disks, _ := state.Get("bootable_volume_disks").(map[string]string)
+	templateFile, _ := state.Get("vm_template_file").(string)
+	return &Artifact{
+		Name:         bootableVolumeName,
+		Namespace:    b.config.outputNamespace(),
+		BuildName:    b.config.buildName(),
+		Disks:        disks,
+		TemplateFile: templateFile,
+	}, nil
 }
 
 func (b *Builder) buildSSHSteps() ([]multistep.Step, []error) {
@@ -158,11 +252,20 @@ func (b *Builder) buildSSHSteps() ([]multistep.Step, []error) {
 				return commConfig.SSH.SSHHost, nil
 			},
 			SSHConfig: func(state multistep.StateBag) (*ssh.ClientConfig, error) {
+				auth := []ssh.AuthMethod{
+					ssh.Password(b.config.SSHPassword),
+				}
+				if keyPair := b.config.sshKeyPair; keyPair != nil {
+					signer, err := ssh.ParsePrivateKey(keyPair.PrivateKeyPemBlock)
+					if err != nil {
+						return nil, err
+					}
+					auth = append([]ssh.AuthMethod{ssh.PublicKeys(signer)}, auth...)
+				}
+
 				return &ssh.ClientConfig{
-					User: b.config.SSHUsername,
-					Auth: []ssh.AuthMethod{
-						ssh.Password(b.config.SSHPassword),
-					},
+					User:            b.config.SSHUsername,
+					Auth:            auth,
 					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 				}, nil
 			},
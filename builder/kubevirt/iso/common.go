@@ -4,17 +4,42 @@
 package iso
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
 
+	v1 "kubevirt.io/api/core/v1"
 	"kubevirt.io/client-go/kubecli"
 	"kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
 )
 
 func WaitUntilDataVolumeSucceeded(ctx context.Context, client kubecli.KubevirtClient, namespace, name string) error {
+	return waitUntilDataVolumePhase(ctx, client, namespace, name, v1beta1.Succeeded)
+}
+
+func WaitUntilDataVolumeUploadReady(ctx context.Context, client kubecli.KubevirtClient, namespace, name string) error {
+	return waitUntilDataVolumePhase(ctx, client, namespace, name, v1beta1.UploadReady)
+}
+
+func waitUntilDataVolumePhase(ctx context.Context, client kubecli.KubevirtClient, namespace, name string, phase v1beta1.DataVolumePhase) error {
 	pollInterval := 15 * time.Second
 	pollTimeout := 3600 * time.Second
 	poller := func(ctx context.Context) (bool, error) {
@@ -23,10 +48,313 @@ func WaitUntilDataVolumeSucceeded(ctx context.Context, client kubecli.KubevirtCl
 			return false, err
 		}
 
-		if dataVolume != nil && dataVolume.Status.Phase == v1beta1.DataVolumePhase(v1beta1.Succeeded) {
+		if dataVolume != nil && dataVolume.Status.Phase == phase {
 			return true, nil
 		}
 		return false, nil
 	}
 	return wait.PollUntilContextTimeout(ctx, pollInterval, pollTimeout, true, poller)
 }
+
+// UploadToDataVolume uploads a local file to a DataVolume with an upload source,
+// through the CDI upload proxy. The DataVolume must be ready to receive the upload.
+func UploadToDataVolume(ctx context.Context, client kubecli.KubevirtClient, namespace, name, uploadProxyURL string, insecure bool, path string) error {
+	tokenRequest, err := client.CdiClient().UploadV1beta1().UploadTokenRequests(namespace).Create(ctx, &uploadv1beta1.UploadTokenRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: uploadv1beta1.UploadTokenRequestSpec{
+			PvcName: name,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(uploadProxyURL, "http://") && !strings.HasPrefix(uploadProxyURL, "https://") {
+		uploadProxyURL = "https://" + uploadProxyURL
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(uploadProxyURL, "/")+"/v1beta1/upload", file)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = info.Size()
+	request.Header.Set("Authorization", "Bearer "+tokenRequest.Status.Token)
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("upload to %s failed with status %s: %s", uploadProxyURL, response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// AuthorizeAccess checks that the user is allowed to perform the given action,
+// through a SelfSubjectAccessReview.
+func AuthorizeAccess(ctx context.Context, client kubecli.KubevirtClient, attributes authorizationv1.ResourceAttributes) error {
+	resource := attributes.Resource
+	if attributes.Subresource != "" {
+		resource += "/" + attributes.Subresource
+	}
+	if attributes.Group != "" {
+		resource += "." + attributes.Group
+	}
+
+	scope := fmt.Sprintf("in namespace %q", attributes.Namespace)
+	if attributes.Namespace == "" {
+		scope = "cluster-wide"
+	}
+
+	review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to review the %q permission on %q %s: %w", attributes.Verb, resource, scope, err)
+	}
+
+	if !review.Status.Allowed {
+		return fmt.Errorf("the %q permission on %q is missing %s", attributes.Verb, resource, scope)
+	}
+	return nil
+}
+
+// AuthorizeVolumeClone checks that the user is allowed to clone volumes from the source namespace
+// into the target namespace, which CDI requires through the "create" permission on the
+// `datavolumes/source` subresource in the source namespace.
+func AuthorizeVolumeClone(ctx context.Context, client kubecli.KubevirtClient, sourceNamespace, targetNamespace string) error {
+	if sourceNamespace == targetNamespace {
+		return nil
+	}
+
+	err := AuthorizeAccess(ctx, client, authorizationv1.ResourceAttributes{
+		Namespace:   sourceNamespace,
+		Verb:        "create",
+		Group:       v1beta1.SchemeGroupVersion.Group,
+		Resource:    "datavolumes",
+		Subresource: "source",
+	})
+	if err != nil {
+		return fmt.Errorf("not allowed to clone volumes from namespace %q into %q: %w", sourceNamespace, targetNamespace, err)
+	}
+	return nil
+}
+
+// VirtioContainerImage returns the VirtIO drivers container image matching the version
+// and registry of the installed KubeVirt.
+func VirtioContainerImage(ctx context.Context, client kubecli.KubevirtClient) (string, error) {
+	kubevirts, err := client.KubeVirt(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list KubeVirt resources: %w", err)
+	}
+
+	for _, kv := range kubevirts.Items {
+		registry := kv.Status.ObservedKubeVirtRegistry
+		version := kv.Status.ObservedKubeVirtVersion
+		if registry != "" && version != "" {
+			return fmt.Sprintf("%s/virtio-container-disk:%s", registry, version), nil
+		}
+	}
+	return "", fmt.Errorf("no deployed KubeVirt resource found to detect the VirtIO drivers image")
+}
+
+// ShutdownVirtualMachine runs a command in the guest which shuts it down, and waits until the VMI
+// has stopped or the command has failed. The VM is switched to the RerunOnFailure run strategy
+// first, so it is not restarted once the guest has shut down.
+func ShutdownVirtualMachine(ctx context.Context, client kubecli.KubevirtClient, namespace, name string, comm packer.Communicator, cmd *packer.RemoteCmd, timeout time.Duration) error {
+	vm, err := client.VirtualMachine(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	vm.Spec.RunStrategy = ptr.To(v1.RunStrategyRerunOnFailure)
+
+	_, err = client.VirtualMachine(namespace).Update(ctx, vm, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	if err := comm.Start(ctx, cmd); err != nil {
+		return err
+	}
+
+	// Stop waiting as soon as the command fails, e.g. if sudo requires a password. The connection
+	// may be closed by the guest shutting down before the exit status is received.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		if status := cmd.Wait(); status != 0 && status != packer.CmdDisconnect {
+			cancel(fmt.Errorf("command %q exited with status %d", cmd.Command, status))
+		}
+	}()
+
+	pollInterval := 5 * time.Second
+	poller := func(ctx context.Context) (bool, error) {
+		vmi, err := client.VirtualMachineInstance(namespace).Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, nil
+		}
+		return vmi.IsFinal(), nil
+	}
+	err = wait.PollUntilContextTimeout(ctx, pollInterval, timeout, true, poller)
+	if cause := context.Cause(ctx); err != nil && cause != nil {
+		return cause
+	}
+	return err
+}
+
+// runPod creates a Pod in the namespace, owned by the build lease and tracked so that it is
+// deleted once the build is done. It streams the logs of the Pod through the UI, and returns
+// the Pod once it has completed, successfully or not.
+func runPod(ctx context.Context, state multistep.StateBag, client kubernetes.Interface, namespace string, pod *corev1.Pod) (*corev1.Pod, error) {
+	ui := state.Get("ui").(packer.Ui)
+	name := pod.Name
+
+	lease, _ := state.Get("build_lease").(*corev1.ConfigMap)
+	pod.OwnerReferences = ownerReferences(lease)
+
+	_, err := client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	trackResource(state, trackedResource{
+		Kind:      "Pod",
+		Namespace: namespace,
+		Name:      name,
+		Delete: func(ctx context.Context) error {
+			return client.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		},
+	})
+
+	if err := streamPodLogs(ctx, ui, client, namespace, name); err != nil {
+		return nil, err
+	}
+	return waitUntilPodCompleted(ctx, client, namespace, name)
+}
+
+// streamPodLogs waits until the Pod has started, then streams its logs through the UI until it exits.
+func streamPodLogs(ctx context.Context, ui packer.Ui, client kubernetes.Interface, namespace, name string) error {
+	pollInterval := 5 * time.Second
+	pollTimeout := 600 * time.Second
+	poller := func(ctx context.Context) (bool, error) {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pod.Status.Phase != corev1.PodPending, nil
+	}
+	if err := wait.PollUntilContextTimeout(ctx, pollInterval, pollTimeout, true, poller); err != nil {
+		return fmt.Errorf("pod (%s/%s) did not start: %w", namespace, name, err)
+	}
+
+	logs, err := client.CoreV1().Pods(namespace).GetLogs(name, &corev1.PodLogOptions{Follow: true}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		ui.Message(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func waitUntilPodCompleted(ctx context.Context, client kubernetes.Interface, namespace, name string) (*corev1.Pod, error) {
+	var pod *corev1.Pod
+	pollInterval := 5 * time.Second
+	pollTimeout := 3600 * time.Second
+	poller := func(ctx context.Context) (bool, error) {
+		var err error
+		pod, err = client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed, nil
+	}
+	if err := wait.PollUntilContextTimeout(ctx, pollInterval, pollTimeout, true, poller); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// trackedResource is a resource created by the build, deleted once the build is done.
+type trackedResource struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Output is set for the resources of the published image,
+	// which are only deleted if the build fails.
+	Output bool
+	Delete func(ctx context.Context) error
+}
+
+// trackResource records a resource created by the build in the state bag,
+// so that it is deleted once the build is done.
+func trackResource(state multistep.StateBag, resource trackedResource) {
+	resources, _ := state.Get("build_resources").([]trackedResource)
+	state.Put("build_resources", append(resources, resource))
+}
+
+// deleteTrackedResources deletes the resources created by the build in reverse order, unless they
+// are kept on success or failure. The resources of the published image are only deleted if the
+// build failed. It returns whether the resources were kept.
+func deleteTrackedResources(state multistep.StateBag, config Config) bool {
+	ui := state.Get("ui").(packer.Ui)
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	failed := cancelled || halted
+
+	resources, _ := state.Get("build_resources").([]trackedResource)
+
+	if config.keepResources(failed) {
+		for _, r := range resources {
+			if !r.Output {
+				ui.Sayf("Keeping %s (%s/%s).", r.Kind, r.Namespace, r.Name)
+			}
+		}
+		return true
+	}
+
+	for i := len(resources) - 1; i >= 0; i-- {
+		r := resources[i]
+		if r.Output && !failed {
+			continue
+		}
+
+		ui.Sayf("Deleting %s (%s/%s)...", r.Kind, r.Namespace, r.Name)
+
+		if err := r.Delete(context.Background()); err != nil && !errors.IsNotFound(err) {
+			ui.Errorf("Failed to delete %s (%s/%s): %s", r.Kind, r.Namespace, r.Name, err)
+		}
+	}
+	state.Put("build_resources", []trackedResource(nil))
+	return false
+}
@@ -5,6 +5,11 @@ package iso_test
 
 import (
 	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 
 	"github.com/golang/mock/gomock"
 
@@ -12,10 +17,13 @@ import (
 	. "github.com/onsi/gomega"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/testing"
 
 	fakecdiclient "kubevirt.io/client-go/containerizeddataimporter/fake"
 	"kubevirt.io/client-go/kubecli"
 	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
 
 	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
 )
@@ -93,3 +101,74 @@ var _ = Describe("WaitUntilDataVolumeSucceeded", func() {
 		Expect(err.Error()).To(ContainSubstring("context canceled"))
 	})
 })
+
+var _ = Describe("UploadToDataVolume", func() {
+	const (
+		namespace = "test-ns"
+		name      = "test-dv"
+	)
+
+	var (
+		ctrl       *gomock.Controller
+		virtClient kubecli.KubevirtClient
+		cdiClient  *fakecdiclient.Clientset
+		path       string
+	)
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+		cdiClient = fakecdiclient.NewSimpleClientset()
+		cdiClient.PrependReactor("create", "uploadtokenrequests", func(action testing.Action) (bool, runtime.Object, error) {
+			request := action.(testing.CreateAction).GetObject().(*uploadv1beta1.UploadTokenRequest)
+			request.Status.Token = "secret-token"
+			return true, request, nil
+		})
+
+		kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
+		kubecli.MockKubevirtClientInstance = kubecli.NewMockKubevirtClient(ctrl)
+		kubecli.MockKubevirtClientInstance.EXPECT().CdiClient().Return(cdiClient).AnyTimes()
+
+		virtClient, _ = kubecli.GetKubevirtClientFromClientConfig(nil)
+
+		path = filepath.Join(GinkgoT().TempDir(), "media.iso")
+		Expect(os.WriteFile(path, []byte("fake iso data"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	It("uploads the file with the upload token", func() {
+		var body []byte
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.URL.Path).To(Equal("/v1beta1/upload"))
+			Expect(r.Header.Get("Authorization")).To(Equal("Bearer secret-token"))
+			body, _ = io.ReadAll(r.Body)
+		}))
+		defer server.Close()
+
+		err := iso.UploadToDataVolume(context.Background(), virtClient, namespace, name, server.URL, true, path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("fake iso data"))
+	})
+
+	It("returns error when the upload proxy rejects the upload", func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+		}))
+		defer server.Close()
+
+		err := iso.UploadToDataVolume(context.Background(), virtClient, namespace, name, server.URL, true, path)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("bad token"))
+	})
+
+	It("returns error when the upload proxy certificate is not trusted", func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		err := iso.UploadToDataVolume(context.Background(), virtClient, namespace, name, server.URL, false, path)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -2,16 +2,33 @@
 // SPDX-License-Identifier: MPL-2.0
 
 //go:generate packer-sdc struct-markdown
-//go:generate packer-sdc mapstructure-to-hcl2 -type Config,Network,NetworkSource,PodNetwork,MultusNetwork
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,Network,NetworkSource,PodNetwork,MultusNetwork,Toleration,Disk,VolumeSource,BlankVolume,PersistentVolumeClaimVolume,SecretVolume,ContainerDiskVolume,CloudInit,CloudInitMetaData,Ignition,OSProfile,VirtualMachineTemplate
 
 package iso
 
 import (
+	"encoding/json"
 	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/common"
+	packerssh "github.com/hashicorp/packer-plugin-sdk/communicator/ssh"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	v1 "kubevirt.io/api/core/v1"
+	instancetypeapi "kubevirt.io/api/instancetype"
 )
 
 // Network represents a network type and a resource that should be connected to the VM.
@@ -59,38 +76,394 @@ type MultusNetwork struct {
 	Default bool `mapstructure:"default,omitempty"`
 }
 
+// Disk represents an additional disk, and the volume backing it, attached to the VM.
+// Source: https://kubevirt.io/api-reference/v1.6.0/definitions.html#_v1_disk
+type Disk struct {
+	// Disk name.
+	// Must be a DNS_LABEL and unique within the VM.
+	Name string `mapstructure:"name"`
+
+	// Type of the disk device.
+	// Supported values are "disk" and "cdrom". Defaults to "disk".
+	Type string `mapstructure:"type,omitempty"`
+
+	// Bus of the disk device, e.g. "virtio", "sata" or "scsi".
+	// Defaults to the bus set by the preference, if any.
+	Bus string `mapstructure:"bus,omitempty"`
+
+	// Boot order of the disk. Disks without a boot order are not tried when booting.
+	// Must be unique within the VM and greater than 3, since orders 1, 2 and 3 are used
+	// by the root disk, the installation ISO and the media CD-ROM.
+	BootOrder int `mapstructure:"bootOrder,omitempty"`
+
+	// Serial number of the disk, as exposed to the guest.
+	Serial string `mapstructure:"serial,omitempty"`
+
+	// Export the disk along with the root disk, as a DataVolume and DataSource
+	// named `<name>-<disk name>`. Only blank disks can be exported.
+	Output bool `mapstructure:"output,omitempty"`
+
+	// VolumeSource represents the volume backing the disk.
+	VolumeSource `mapstructure:",squash"`
+}
+
+// Represents the source of the volume backing a disk.
+// Only one of its members may be specified.
+type VolumeSource struct {
+	Blank                 *BlankVolume                 `mapstructure:"blank"`
+	PersistentVolumeClaim *PersistentVolumeClaimVolume `mapstructure:"persistentVolumeClaim"`
+	Secret                *SecretVolume                `mapstructure:"secret"`
+	ContainerDisk         *ContainerDiskVolume         `mapstructure:"containerDisk"`
+}
+
+// Represents a new blank volume, created along with the temporary VM.
+type BlankVolume struct {
+	// Size of the blank volume, e.g. "20Gi".
+	Size string `mapstructure:"size"`
+}
+
+// Represents an existing PersistentVolumeClaim.
+// Source: https://kubevirt.io/api-reference/v1.6.0/definitions.html#_v1_persistentvolumeclaimvolumesource
+type PersistentVolumeClaimVolume struct {
+	// Name of the PersistentVolumeClaim in the VM namespace.
+	ClaimName string `mapstructure:"claimName"`
+
+	// Attach the volume in read-only mode.
+	ReadOnly bool `mapstructure:"readOnly,omitempty"`
+}
+
+// Represents an existing Secret, attached as a disk.
+// Source: https://kubevirt.io/api-reference/v1.6.0/definitions.html#_v1_secretvolumesource
+type SecretVolume struct {
+	// Name of the Secret in the VM namespace.
+	SecretName string `mapstructure:"secretName"`
+
+	// Volume label of the resulting disk inside the VM.
+	VolumeLabel string `mapstructure:"volumeLabel,omitempty"`
+}
+
+// Represents a container image with an embedded disk.
+// Source: https://kubevirt.io/api-reference/v1.6.0/definitions.html#_v1_containerdisksource
+type ContainerDiskVolume struct {
+	// Name of the image with the embedded disk.
+	Image string `mapstructure:"image"`
+
+	// Name of the Secret required to pull the image.
+	// The Secret must already exist in the VM namespace.
+	ImagePullSecret string `mapstructure:"imagePullSecret,omitempty"`
+
+	// Path to the disk file in the container.
+	Path string `mapstructure:"path,omitempty"`
+}
+
+// Represents the cloud-init data source attached to the VM, e.g. for installers
+// looking for a cidata volume such as Ubuntu autoinstall.
+// Source: https://kubevirt.io/api-reference/v1.6.0/definitions.html#_v1_cloudinitnocloudsource
+type CloudInit struct {
+	// Type of the data source.
+	// Supported values are "NoCloud" and "ConfigDrive". Defaults to "NoCloud".
+	// NoCloud cannot be used along with a media CD-ROM labelled "cidata", e.g. with the
+	// ubuntu-autoinstall OS profile, since cloud-init would read both.
+	Type string `mapstructure:"type,omitempty"`
+
+	// Cloud-init user data.
+	UserData string `mapstructure:"user_data,omitempty"`
+
+	// Name of a Secret in the VM namespace containing the cloud-init user data
+	// under the "userdata" key.
+	UserDataSecretRef string `mapstructure:"user_data_secret_ref,omitempty"`
+
+	// Cloud-init network data.
+	NetworkData string `mapstructure:"network_data,omitempty"`
+
+	// Name of a Secret in the VM namespace containing the cloud-init network data
+	// under the "networkdata" key.
+	NetworkDataSecretRef string `mapstructure:"network_data_secret_ref,omitempty"`
+
+	// Cloud-init meta data. KubeVirt generates the meta data of the data source,
+	// with the VM name as the instance ID, so only the keys below can be set.
+	MetaData *CloudInitMetaData `mapstructure:"meta_data,omitempty"`
+}
+
+// Represents the keys of the cloud-init meta data which can be set through KubeVirt.
+type CloudInitMetaData struct {
+	// Hostname of the guest, set as "local-hostname" in the meta data.
+	// It must be a valid DNS-1123 label. Defaults to the name of the temporary VM.
+	LocalHostname string `mapstructure:"local_hostname,omitempty"`
+
+	// Name of a Secret in the VM namespace whose values are SSH public keys,
+	// set as "public_keys" in the meta data. Only supported by the ConfigDrive data source.
+	PublicKeysSecretRef string `mapstructure:"public_keys_secret_ref,omitempty"`
+}
+
+// Represents the Ignition config of Fedora CoreOS and RHCOS VMs, passed through the
+// kubevirt.io/ignitiondata annotation. This requires the ExperimentalIgnitionSupport feature gate.
+// Butane configs must be transpiled to Ignition beforehand, e.g. with `butane --strict`.
+// Only one of its members may be specified.
+type Ignition struct {
+	// Inline Ignition config, in JSON format.
+	Config string `mapstructure:"config,omitempty"`
+
+	// Path of a local file containing the Ignition config, in JSON format.
+	File string `mapstructure:"file,omitempty"`
+}
+
+// Represents the layout of the temporary VM for an operating system, and how the builder
+// interacts with it. Used to describe a custom OS profile, when os_type is set to "custom".
+type OSProfile struct {
+	// Bus of the CD-ROM drives, e.g. "sata" or "scsi".
+	// Defaults to the KubeVirt default bus.
+	CDRomBus string `mapstructure:"cdromBus,omitempty"`
+
+	// Bus of the root disk, e.g. "virtio" or "sata".
+	// Defaults to the KubeVirt default bus.
+	DiskBus string `mapstructure:"diskBus,omitempty"`
+
+	// How the media files are attached to the VM.
+	// Supported values are "cdrom", for a CD-ROM labelled with the media volume label,
+	// "sysprep", for a Windows sysprep volume, and "none", in which case the media files
+	// are rejected. Defaults to "cdrom".
+	Media string `mapstructure:"media,omitempty"`
+
+	// Volume label of the media CD-ROM, unless media_volume_label is set.
+	// Defaults to "OEMDRV".
+	MediaVolumeLabel string `mapstructure:"mediaVolumeLabel,omitempty"`
+
+	// Attach the VirtIO drivers to the VM, see virtio_container_image.
+	VirtioDrivers bool `mapstructure:"virtioDrivers,omitempty"`
+
+	// Communicator used when communicator is not set and a username is set
+	// for this communicator. Supported values are "ssh" and "winrm".
+	Communicator string `mapstructure:"communicator,omitempty"`
+
+	// Command to shut down the guest.
+	ShutdownCommand string `mapstructure:"shutdownCommand,omitempty"`
+
+	// Command to generalize the guest before it is captured, when seal is set.
+	// The command must shut down the guest once done.
+	SealCommand string `mapstructure:"sealCommand,omitempty"`
+
+	// Command to discard the unused blocks of the guest filesystems, when fstrim is set.
+	TrimCommand string `mapstructure:"trimCommand,omitempty"`
+}
+
+// Represents a manifest of a VirtualMachine booting from the image, published alongside it.
+// The VirtualMachine uses the default instance type and preference of the image,
+// the networks of the temporary VM, and clones every exported disk.
+type VirtualMachineTemplate struct {
+	// Kind of the manifest.
+	// Supported values are "VirtualMachine" and "Template", for an OpenShift Template
+	// with a NAME parameter. Defaults to "VirtualMachine".
+	Kind string `mapstructure:"kind,omitempty"`
+
+	// Name of the manifest. Defaults to the name of the VM image.
+	Name string `mapstructure:"name,omitempty"`
+
+	// Path of a local file to write the manifest to, in YAML format.
+	Path string `mapstructure:"path,omitempty"`
+
+	// Create the manifest in the namespace of the VM image.
+	// A VirtualMachine is created halted. An existing one is only replaced with force.
+	Create bool `mapstructure:"create,omitempty"`
+}
+
+// Toleration allows the VM to be scheduled onto nodes with matching taints.
+// Source: https://kubernetes.io/docs/reference/kubernetes-api/workload-resources/pod-v1/#scheduling
+type Toleration struct {
+	// Taint key that the toleration applies to.
+	// Empty means match all taint keys, in which case the operator must be "Exists".
+	Key string `mapstructure:"key"`
+
+	// Relationship of the key to the value.
+	// Valid operators are "Exists" and "Equal". Defaults to "Equal".
+	Operator string `mapstructure:"operator,omitempty"`
+
+	// Taint value the toleration matches to.
+	// Must be empty if the operator is "Exists".
+	Value string `mapstructure:"value,omitempty"`
+
+	// Taint effect to match. Empty means match all taint effects.
+	// Valid effects are "NoSchedule", "PreferNoSchedule" and "NoExecute".
+	Effect string `mapstructure:"effect,omitempty"`
+
+	// Period of time the toleration tolerates a "NoExecute" taint.
+	// If not set, the taint is tolerated forever.
+	TolerationSeconds *int64 `mapstructure:"tolerationSeconds,omitempty"`
+}
+
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 
 	// KubeConfig is the path to the kubeconfig file.
 	KubeConfig string `mapstructure:"kube_config" required:"true"`
-	// Name is the name of the VM image.
+	// Name is the name of the VM image. The temporary VM and its resources are named after it,
+	// with a random suffix unique to each build. Must be a DNS_LABEL.
 	Name string `mapstructure:"name" required:"true"`
-	// Namespace is the namespace in which to create the VM image.
+	// Namespace is the namespace in which to create the VM image. It is the default of
+	// iso_namespace, build_namespace and output_namespace.
 	Namespace string `mapstructure:"namespace" required:"true"`
+	// IsoNamespace is the namespace of the ISO DataVolume. If it differs from the build namespace,
+	// the ISO is cloned into the build namespace, which requires the "create" permission on
+	// `datavolumes/source` in the ISO namespace. Defaults to namespace.
+	IsoNamespace string `mapstructure:"iso_namespace" required:"false"`
+	// BuildNamespace is the namespace of the temporary VM and its volumes, ConfigMap and Secret.
+	// Defaults to namespace.
+	BuildNamespace string `mapstructure:"build_namespace" required:"false"`
+	// OutputNamespace is the namespace of the published DataVolume, DataSource and VM template.
+	// If it differs from the build namespace, the root disk is cloned into it, which requires the
+	// "create" permission on `datavolumes/source` in the build namespace. Defaults to namespace.
+	OutputNamespace string `mapstructure:"output_namespace" required:"false"`
 	// ISO Volume Name is the name of the DataVolume resource that contains the installation ISO.
-	// This DataVolume must already exist in the namespace.
+	// This DataVolume must already exist in the ISO namespace.
 	IsoVolumeName string `mapstructure:"iso_volume_name" required:"true"`
-	// DiskSize is the size of the root disk to of the temporary VM.
+	// DiskSize is the size of the root disk of the temporary VM, e.g. "64Gi".
 	DiskSize string `mapstructure:"disk_size" required:"true"`
+	// OutputDiskSize is the size of the published root disk volume, e.g. "12Gi", or "minimal" to
+	// size it after the partitions of the guest. Defaults to disk_size.
+	//
+	// If it is smaller than disk_size, the root disk of the stopped VM is copied into a smaller
+	// volume with `virt-resize`, in a Pod running the `customize_image`, and the smaller volume
+	// is published. virt-resize moves the partitions but does not shrink their filesystems, so the
+	// partitions must fit in the output size, e.g. they must not be grown to fill the disk during
+	// the installation. The build fails if the partitions end past the output size, or if the
+	// guest filesystems use more space than the output size.
+	//
+	// If it is larger than disk_size, the disk is grown but the guest filesystems are not.
+	OutputDiskSize string `mapstructure:"output_disk_size" required:"false"`
+	// Sparsify indicates whether to sparsify the root disk of the stopped VM with `virt-sparsify`,
+	// in the libguestfs Pod of `customize_commands`, so that unused blocks are not stored nor cloned.
+	Sparsify bool `mapstructure:"sparsify" required:"false"`
+	// Fstrim indicates whether to discard the unused blocks of the guest filesystems through the
+	// communicator, before the guest is sealed or shut down, with the trim command of the OS profile,
+	// e.g. "sudo fstrim --all --verbose" for Linux. Along with sparsify, this reduces the space used
+	// by the published image. A failure to trim the filesystems is reported but does not fail the build.
+	Fstrim bool `mapstructure:"fstrim" required:"false"`
 	// InstanceType is the name of the InstanceType resource to use in the temporary VM.
-	InstanceType string `mapstructure:"instance_type" required:"true"`
+	// If not set, the VM is sized with `cpu` and `memory` instead.
+	InstanceType string `mapstructure:"instance_type" required:"false"`
 	// InstanceTypeKind is the kind of the InstanceType resource to use in the temporary VM.
-	// Other supported value is "virtualmachineclusterinstancetype".
+	// Supported values are "virtualmachineinstancetype" and "virtualmachineclusterinstancetype".
+	// Defaults to "virtualmachineclusterinstancetype".
 	InstanceTypeKind string `mapstructure:"instance_type_kind" required:"false"`
 	// Preference is the name of the Preference resource to use in the temporary VM.
-	Preference string `mapstructure:"preference" required:"true"`
+	// If not set, no preference is applied to the VM.
+	Preference string `mapstructure:"preference" required:"false"`
 	// PreferenceKind is the kind of the Preference resource to use in the temporary VM.
-	// Other supported value is "virtualmachineclusterpreference".
+	// Supported values are "virtualmachinepreference" and "virtualmachineclusterpreference".
+	// Defaults to "virtualmachineclusterpreference".
 	PreferenceKind string `mapstructure:"preference_kind" required:"false"`
+	// CPU is the number of virtual CPU cores of the temporary VM.
+	// Cannot be set together with an instance type.
+	CPU int `mapstructure:"cpu" required:"false"`
+	// Memory is the amount of guest memory of the temporary VM, e.g. "4Gi".
+	// Required if no instance type is set, and cannot be set together with one.
+	Memory string `mapstructure:"memory" required:"false"`
+	// MachineType is the emulated machine type of the temporary VM, e.g. "q35".
+	// If not set, the cluster-wide default is used.
+	MachineType string `mapstructure:"machine_type" required:"false"`
+	// DefaultInstanceType is the name of the InstanceType that VMs created from the image
+	// default to. It is set as a label of the output DataSource.
+	// Defaults to the instance type of the temporary VM.
+	DefaultInstanceType string `mapstructure:"default_instance_type" required:"false"`
+	// DefaultPreference is the name of the Preference that VMs created from the image
+	// default to. It is set as a label of the output DataSource.
+	// Defaults to the preference of the temporary VM.
+	DefaultPreference string `mapstructure:"default_preference" required:"false"`
 	// OperatingSystemType is the type of operating system to install.
-	// Supported values are "linux" and "windows". Default is "linux".
+	// It selects the OS profile, which describes the layout of the temporary VM
+	// and how the builder interacts with it. Supported values are:
+	//
+	// - "linux": the media files are attached as a CD-ROM labelled "OEMDRV", picked up by Anaconda.
+	// - "windows": the media files are attached as a sysprep volume, along with the VirtIO drivers.
+	// - "ubuntu-autoinstall": the media files are attached as a CD-ROM labelled "cidata",
+	//   picked up by Subiquity as NoCloud data, e.g. `user-data` and `meta-data` files.
+	// - "coreos": boots a CoreOS live ISO, which installs to the root disk with coreos-installer,
+	//   without attaching the media files.
+	// - "freebsd": the media files are attached as a CD-ROM, on SATA drives.
+	// - "custom": the OS profile is described by `os_profile`.
+	//
+	// Default is "linux".
 	OperatingSystemType string `mapstructure:"os_type" required:"false"`
+	// OSProfile describes the layout of the temporary VM when os_type is set to "custom".
+	OSProfile *OSProfile `mapstructure:"os_profile" required:"false"`
+	// VirtioContainerImage is the container image providing the VirtIO drivers to Windows VMs.
+	// Set to "auto" to use the image matching the version of the installed KubeVirt,
+	// as reported by the KubeVirt resource.
+	// Defaults to "quay.io/kubevirt/virtio-container-disk:v1.5.2".
+	VirtioContainerImage string `mapstructure:"virtio_container_image" required:"false"`
+	// VirtioClaimName is the name of an existing PersistentVolumeClaim, e.g. of a DataVolume,
+	// providing the VirtIO drivers to Windows VMs instead of a container image.
+	VirtioClaimName string `mapstructure:"virtio_claim_name" required:"false"`
+	// DisableVirtioDrivers indicates whether to not attach the VirtIO drivers to Windows VMs,
+	// e.g. when the preference uses SATA disks and e1000 network interfaces.
+	DisableVirtioDrivers bool `mapstructure:"disable_virtio_drivers" required:"false"`
 	// Networks is a list of networks to attach to the temporary VM.
-	// If no networks are specified, a single pod network will be used.
+	// If no networks are specified, a single pod network will be used. Otherwise, exactly one of
+	// them must be the default network: the pod network, or a multus network set as default.
 	Networks []Network `mapstructure:"networks" required:"false"`
+	// Disks is a list of additional disks to attach to the temporary VM,
+	// besides the root disk and the installation media.
+	Disks []Disk `mapstructure:"disks" required:"false"`
+	// NodeSelector is a map of node labels that the temporary VM must be scheduled on.
+	NodeSelector map[string]string `mapstructure:"node_selector" required:"false"`
+	// Tolerations is a list of tolerations that allow the temporary VM to be scheduled onto tainted nodes.
+	Tolerations []Toleration `mapstructure:"tolerations" required:"false"`
+	// Affinity is the Kubernetes affinity of the temporary VM, encoded as YAML or JSON,
+	// e.g. `jsonencode({ nodeAffinity = { ... } })`.
+	// More info: https://kubernetes.io/docs/concepts/scheduling-eviction/assign-pod-node/#affinity-and-anti-affinity
+	Affinity string `mapstructure:"affinity" required:"false"`
+	// PriorityClassName is the name of the PriorityClass to assign to the temporary VM.
+	PriorityClassName string `mapstructure:"priority_class_name" required:"false"`
+	// EvictionStrategy is the strategy applied to the temporary VM when its node is drained.
+	// Supported values are "None", "LiveMigrate", "LiveMigrateIfPossible" and "External".
+	// If not set, the cluster-wide default is used.
+	//
+	// "External" blocks the eviction of the VM, which prevents a node drain from
+	// interrupting the installation.
+	EvictionStrategy string `mapstructure:"eviction_strategy" required:"false"`
 	// MediaFiles is a path list of files to be copied and used during the ISO installation.
+	// Entries can be files, directories or glob patterns. Files are placed at the root of the media,
+	// while directories keep their name and structure, e.g. `./scripts` results in `scripts/setup.ps1`.
+	// Two media files with the same resulting path are rejected.
+	//
+	// ConfigMap and Secret keys cannot represent directories, so media files with nested
+	// paths are always uploaded as an ISO image, see `media_files_iso`.
 	MediaFiles []string `mapstructure:"media_files" required:"false"`
+	// MediaContent is a map of files to be added to the media, keyed by their path relative to the root
+	// of the media, which can neither be absolute nor contain "..". The content is rendered like
+	// `media_templates`, which also makes it possible
+	// to generate files with the HCL `templatefile` function, e.g.:
+	//
+	// ```hcl
+	// media_content = {
+	//   "ks.cfg" = templatefile("ks.pkrtpl.hcl", { password = var.password })
+	// }
+	// ```
+	MediaContent map[string]string `mapstructure:"media_content" required:"false"`
+	// MediaTemplates is a path list of files rendered as Go templates before being added to the media.
+	// Entries follow the same rules as `media_files`. The templates can refer to `{{ .Name }}`,
+	// `{{ .Namespace }}`, `{{ .SSHUsername }}`, `{{ .SSHPassword }}`, `{{ .SSHPublicKey }}`,
+	// `{{ .WinRMUsername }}` and `{{ .WinRMPassword }}`, as well as the `build_name` function.
+	MediaTemplates []string `mapstructure:"media_templates" required:"false"`
+	// MediaVolumeLabel is the volume label of the media CD-ROM. Defaults to the label of the OS profile,
+	// "OEMDRV" for Linux, which is picked up by Anaconda. Set to "cidata" to provide NoCloud data,
+	// e.g. `user-data` and `meta-data` files, to cloud-init based installers.
+	MediaVolumeLabel string `mapstructure:"media_volume_label" required:"false"`
+	// MediaFilesSecret indicates whether to store the media files in a Secret instead of a ConfigMap.
+	// This should be set when the media files contain credentials, e.g. passwords in
+	// kickstart or answer files, so they are not readable by anyone with view access to the namespace.
+	MediaFilesSecret bool `mapstructure:"media_files_secret" required:"false"`
+	// MediaFilesISO indicates whether to always upload the media files as an ISO image into a DataVolume,
+	// instead of storing them in a ConfigMap or Secret. The media files are uploaded as an ISO image anyway
+	// if they exceed the 1 MiB size limit of a ConfigMap.
+	//
+	// Building the ISO image requires one of xorriso, mkisofs, hdiutil or oscdimg on the host.
+	MediaFilesISO bool `mapstructure:"media_files_iso" required:"false"`
+	// MediaUploadProxyURL is the URL of the CDI upload proxy used to upload the media files ISO image.
+	// If not set, the URL is taken from the status of the CDIConfig resource.
+	MediaUploadProxyURL string `mapstructure:"media_upload_proxy_url" required:"false"`
+	// MediaUploadInsecure indicates whether to skip the TLS verification of the CDI upload proxy.
+	MediaUploadInsecure bool `mapstructure:"media_upload_insecure" required:"false"`
 	// BootCommand is a list of strings that represent the keystrokes to be sent to the VM console
 	// to automate the installation via a new VNC connection.
 	BootCommand []string `mapstructure:"boot_command" required:"false"`
@@ -99,26 +472,74 @@ type Config struct {
 	BootWait time.Duration `mapstructure:"boot_wait" required:"false"`
 	// InstallationWaitTimeout is the amount of time to wait for the installation to be completed.
 	InstallationWaitTimeout time.Duration `mapstructure:"installation_wait_timeout" required:"true"`
+	// ShutdownCommand is the command run through the communicator to gracefully shut down the guest
+	// once provisioning is done. Defaults to the shutdown command of the OS profile, e.g.
+	// "sudo shutdown -P now" for Linux, where sudo reads ssh_password from its standard input.
+	// Commands starting with "sudo -S" are given ssh_password on their standard input as well.
+	// If the command fails, or if no communicator is used, the VM is stopped right away.
+	ShutdownCommand string `mapstructure:"shutdown_command" required:"false"`
+	// CustomizeCommands is a list of shell commands run against the root disk of the stopped VM,
+	// in a Pod running libguestfs tools, before the image is published. The path of the disk image
+	// is available in the `DISK` environment variable, e.g.:
+	//
+	// ```hcl
+	// customize_commands = [
+	//   "virt-customize -a $DISK --uninstall cloud-init",
+	//   "virt-sysprep -a $DISK --operations machine-id,ssh-hostkeys",
+	//   "virt-sparsify --in-place $DISK",
+	// ]
+	// ```
+	//
+	// The Pod is scheduled with the node selector, tolerations and affinity of the temporary VM,
+	// and requests the devices.kubevirt.io/kvm resource.
+	CustomizeCommands []string `mapstructure:"customize_commands" required:"false"`
+	// CustomizeImage is the container image providing the libguestfs tools.
+	// Defaults to "quay.io/kubevirt/libguestfs-tools:v1.5.2".
+	CustomizeImage string `mapstructure:"customize_image" required:"false"`
+	// Seal indicates whether to generalize the guest through the communicator once provisioning
+	// is done, with the seal command of the OS profile. The seal command shuts down the guest,
+	// so the VM is not shut down with the shutdown command. For Windows, sysprep generalizes the
+	// guest. For Linux, the machine-id, the SSH host keys and the cloud-init state are cleared.
+	Seal bool `mapstructure:"seal" required:"false"`
+	// SealCommand is the command run through the communicator to generalize the guest when
+	// seal is set. The command must shut down the guest once done, the build fails if it exits
+	// with an error. Defaults to the seal command of the OS profile, where sudo reads
+	// ssh_password from its standard input.
+	SealCommand string `mapstructure:"seal_command" required:"false"`
+	// SealTimeout is the amount of time to wait for the guest to shut down after the seal
+	// command has been run. Defaults to 30m.
+	SealTimeout time.Duration `mapstructure:"seal_timeout" required:"false"`
+	// ShutdownTimeout is the amount of time to wait for the guest to shut down after the shutdown
+	// command has been run, before the VM is forcibly stopped. Defaults to 5m.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout" required:"false"`
 	// Communicator is the type of communicator to use to connect to the VM.
-	// Supported values are "ssh" and "winrm".
+	// Supported values are "ssh", "winrm" and "none". Defaults to the communicator of the
+	// OS profile if its username is set, none otherwise.
 	Communicator string `mapstructure:"communicator" required:"false"`
 	// SSHHost is the hostname or IP address to use to connect via SSH.
 	SSHHost string `mapstructure:"ssh_host" required:"false"`
 	// SSHLocalPort is the local port to use to connect via SSH.
+	// Required with the ssh communicator.
 	SSHLocalPort int `mapstructure:"ssh_local_port" required:"false"`
-	// SSHRemotePort is the remote port to use to connect via SSH.
+	// SSHRemotePort is the remote port to use to connect via SSH. Defaults to 22.
 	SSHRemotePort int `mapstructure:"ssh_remote_port" required:"false"`
 	// SSHUsername is the username to use to connect via SSH.
 	SSHUsername string `mapstructure:"ssh_username" required:"false"`
 	// SSHPassword is the password to use to connect via SSH.
 	SSHPassword string `mapstructure:"ssh_password" required:"false"`
+	// SSHPrivateKeyFile is the path of a PEM encoded private key to use to connect via SSH, along with
+	// ssh_password if set. If not set, a temporary ECDSA key pair is generated for each build with the
+	// ssh communicator. The public key is available to the media templates as `{{ .SSHPublicKey }}`,
+	// e.g. to authorize it for ssh_username in a kickstart or autoinstall file.
+	SSHPrivateKeyFile string `mapstructure:"ssh_private_key_file" required:"false"`
 	// SSHWaitTimeout is the amount of time to wait for the SSH service to be available.
 	SSHWaitTimeout time.Duration `mapstructure:"ssh_wait_timeout" required:"false"`
 	// WinRMHost is the hostname or IP address to use to connect via WinRM.
 	WinRMHost string `mapstructure:"winrm_host" required:"false"`
 	// WinRMLocalPort is the local port to use to connect via WinRM.
+	// Required with the winrm communicator.
 	WinRMLocalPort int `mapstructure:"winrm_local_port" required:"false"`
-	// WinRMRemotePort is the remote port to use to connect via WinRM.
+	// WinRMRemotePort is the remote port to use to connect via WinRM. Defaults to 5985.
 	WinRMRemotePort int `mapstructure:"winrm_remote_port" required:"false"`
 	// WinRMUsername is the username to use to connect via WinRM.
 	WinRMUsername string `mapstructure:"winrm_username" required:"false"`
@@ -127,30 +548,883 @@ type Config struct {
 	// WinRMWaitTimeout is the amount of time to wait for the WinRM service to be available.
 	WinRMWaitTimeout time.Duration `mapstructure:"winrm_wait_timeout" required:"false"`
 
-	// KeepVM indicates whether to keep the temporary VM after the image has been created.
-	// If false, the VM and all its resources will be deleted after the image is created.
-	// If true, only the VM resource will be kept, all other resources will be deleted.
-	// Default is false.
+	// CloudInit is a cloud-init data source attached to the temporary VM.
+	// The meta data is generated by KubeVirt from the VM.
+	CloudInit *CloudInit `mapstructure:"cloud_init" required:"false"`
+
+	// Ignition is the Ignition config passed to the temporary VM.
+	Ignition *Ignition `mapstructure:"ignition" required:"false"`
+
+	// VirtualMachineTemplate is a manifest of a VirtualMachine booting from the image,
+	// written to a local file or created in the cluster once the image is published.
+	VirtualMachineTemplate *VirtualMachineTemplate `mapstructure:"vm_template" required:"false"`
+
+	// KeepOnSuccess indicates whether to keep the temporary VM and all its resources, e.g. its
+	// disks, ConfigMap and Pods, once the image has been published. Default is false.
+	KeepOnSuccess bool `mapstructure:"keep_on_success" required:"false"`
+	// KeepOnFailure indicates whether to keep the temporary VM and all its resources, along with
+	// the partially published image, if the build fails or is cancelled. Default is false.
 	//
 	// This can be useful for debugging purposes, to inspect the VM and its disks.
-	// However, it is recommended to set this to false in production environments to avoid
-	// resource leaks.
+	// The kept resources are owned by the build lease, and deleted along with it.
+	KeepOnFailure bool `mapstructure:"keep_on_failure" required:"false"`
+	// KeepVM indicates whether to keep the temporary VM and all its resources,
+	// whether the build succeeds or not.
+	//
+	// Deprecated: use keep_on_success and keep_on_failure instead.
 	KeepVM bool `mapstructure:"keep_vm" required:"false"`
+	// Force indicates whether to replace the published image if it already exists, as done
+	// when running `packer build -force`. The image is published under a new volume first,
+	// then the existing DataSource is switched to it, and the previous volume is deleted,
+	// so that the DataSource never goes missing. The VirtualMachine or Template created by
+	// vm_template is replaced too. Default is false.
+	Force bool `mapstructure:"force" required:"false"`
+	// BuildLeaseTTL is the time after which the build lease of an interrupted build is considered
+	// stale. The build lease is a ConfigMap owning all the temporary resources of the build, so that
+	// deleting it deletes them as well. Defaults to 24h.
+	BuildLeaseTTL time.Duration `mapstructure:"build_lease_ttl" required:"false"`
+	// CleanupStaleBuilds indicates whether to delete the stale build leases of the build namespace,
+	// along with the resources they own, at the start of the build. Default is false.
+	CleanupStaleBuilds bool `mapstructure:"cleanup_stale_builds" required:"false"`
+
+	ctx interpolate.Context
+	// buildID is the suffix of the names of the temporary resources, unique to each build.
+	buildID string
+	// sshKeyPair is the key pair to connect via SSH, read from ssh_private_key_file
+	// or generated by Builder.Run.
+	sshKeyPair *packerssh.KeyPair
 }
 
 func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	err := config.Decode(c, &config.DecodeOpts{
-		PluginType:  "builder.kubevirt.iso",
-		Interpolate: true,
+		PluginType:         "builder.kubevirt.iso",
+		Interpolate:        true,
+		InterpolateContext: &c.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{
+				"media_content",
+			},
+		},
 	}, raws...)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, n := range c.Networks {
+	for _, password := range []string{c.SSHPassword, c.WinRMPassword} {
+		if password != "" {
+			packer.LogSecretFilter.Set(password)
+		}
+	}
+
+	var errs *packer.MultiError
+
+	c.applyDefaults()
+
+	if c.Name == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("name must be set"))
+	} else if msgs := validation.IsDNS1123Label(c.Name); len(msgs) > 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("name %q is not valid: %s", c.Name, strings.Join(msgs, ", ")))
+	} else if maxLength := c.maxNameLength(); len(c.Name) > maxLength {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("name %q is too long: it must be no more than %d characters, "+
+			"since the names of the temporary resources derived from it must be valid DNS-1123 labels", c.Name, maxLength))
+	}
+
+	if c.Namespace == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("namespace must be set"))
+	}
+	namespaces := []struct{ key, value string }{
+		{"namespace", c.Namespace},
+		{"iso_namespace", c.IsoNamespace},
+		{"build_namespace", c.BuildNamespace},
+		{"output_namespace", c.OutputNamespace},
+	}
+	for _, ns := range namespaces {
+		if ns.value == "" {
+			continue
+		}
+		if msgs := validation.IsDNS1123Label(ns.value); len(msgs) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("%s %q is not valid: %s", ns.key, ns.value, strings.Join(msgs, ", ")))
+		}
+	}
+
+	if c.IsoVolumeName == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("iso_volume_name must be set"))
+	} else if msgs := validation.IsDNS1123Subdomain(c.IsoVolumeName); len(msgs) > 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("iso_volume_name %q is not valid: %s", c.IsoVolumeName, strings.Join(msgs, ", ")))
+	}
+
+	if _, err := parsePositiveQuantity(c.DiskSize); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("disk_size: %w", err))
+	}
+
+	if c.OutputDiskSize != "" && c.OutputDiskSize != "minimal" {
+		if _, err := parsePositiveQuantity(c.OutputDiskSize); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("output_disk_size: %w", err))
+		}
+	}
+
+	errs = packer.MultiErrorAppend(errs, validateNetworks(c.Networks)...)
+
+	diskNames := map[string]bool{}
+	bootOrders := map[int]string{}
+	for _, d := range c.Disks {
+		if err := validateDisk(d); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("disk %q: %w", d.Name, err))
+		}
+		if diskNames[d.Name] || reservedDiskNames[d.Name] {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("disk %q: name is already in use", d.Name))
+		}
+		diskNames[d.Name] = true
+
+		if d.BootOrder <= 0 {
+			continue
+		}
+		if d.BootOrder <= maxReservedBootOrder {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("disk %q: boot order %d is reserved, set a boot order greater than %d", d.Name, d.BootOrder, maxReservedBootOrder))
+		} else if other, ok := bootOrders[d.BootOrder]; ok {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("disk %q: boot order %d is already used by disk %q", d.Name, d.BootOrder, other))
+		}
+		bootOrders[d.BootOrder] = d.Name
+	}
+
+	if c.InstanceType != "" && (c.CPU != 0 || c.Memory != "") {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("cpu and memory cannot be set together with an instance type"))
+	}
+
+	if c.InstanceType == "" && c.Memory == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("memory must be set if no instance type is set"))
+	}
+
+	if c.CPU < 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("cpu must not be negative"))
+	}
+
+	if c.Memory != "" {
+		if _, err := parsePositiveQuantity(c.Memory); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("memory: %w", err))
+		}
+	}
+
+	switch c.InstanceTypeKind {
+	case instancetypeapi.SingularResourceName, instancetypeapi.ClusterSingularResourceName:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("instance_type_kind %q is not supported, set '%s' or '%s'",
+			c.InstanceTypeKind, instancetypeapi.SingularResourceName, instancetypeapi.ClusterSingularResourceName))
+	}
+
+	switch c.PreferenceKind {
+	case instancetypeapi.SingularPreferenceResourceName, instancetypeapi.ClusterSingularPreferenceResourceName:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("preference_kind %q is not supported, set '%s' or '%s'",
+			c.PreferenceKind, instancetypeapi.SingularPreferenceResourceName, instancetypeapi.ClusterSingularPreferenceResourceName))
+	}
+
+	if t := c.VirtualMachineTemplate; t != nil {
+		if t.Kind != "VirtualMachine" && t.Kind != "Template" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("vm_template: kind %q is not supported, set 'VirtualMachine' or 'Template'", t.Kind))
+		}
+		if msgs := validation.IsDNS1123Subdomain(t.Name); t.Name != "" && len(msgs) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("vm_template: name %q is not valid: %s", t.Name, strings.Join(msgs, ", ")))
+		}
+		if t.Path == "" && !t.Create {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("vm_template: at least one of path or create must be set"))
+		}
+	}
+
+	for _, relPath := range slices.Sorted(maps.Keys(c.MediaContent)) {
+		if err := validateMediaPath(relPath); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("media_content: %w", err))
+		}
+	}
+
+	profile, err := c.osProfile()
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	} else {
+		switch profile.Media {
+		case "", "cdrom", "sysprep", "none":
+		default:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("os_profile: media %q is not supported, set 'cdrom', 'sysprep' or 'none'", profile.Media))
+		}
+
+		// The media is not attached to the VM, e.g. CoreOS is configured by its boot command.
+		hasMedia := len(c.MediaFiles) > 0 || len(c.MediaContent) > 0 || len(c.MediaTemplates) > 0
+		if profile.Media == "none" && hasMedia {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("media_files, media_content and media_templates are not supported by an OS profile without media"))
+		}
+
+		if c.Communicator == "" {
+			switch {
+			case profile.Communicator == "ssh" && c.SSHUsername != "":
+				c.Communicator = "ssh"
+			case profile.Communicator == "winrm" && c.WinRMUsername != "":
+				c.Communicator = "winrm"
+			}
+		}
+
+		if c.Seal && c.sealCommand() == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("seal_command must be set if the OS profile has no seal command"))
+		}
+
+		if c.Fstrim && profile.TrimCommand == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("fstrim is not supported by the OS profile, which has no trim command"))
+		}
+	}
+
+	errs = packer.MultiErrorAppend(errs, c.validateCommunicator()...)
+
+	if c.SSHPrivateKeyFile != "" {
+		if err := c.readSSHKeyPair(); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("ssh_private_key_file: %w", err))
+		}
+	}
+
+	if c.Seal && c.Communicator != "ssh" && c.Communicator != "winrm" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("seal requires the ssh or winrm communicator"))
+	}
+
+	if c.Fstrim && c.Communicator != "ssh" && c.Communicator != "winrm" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("fstrim requires the ssh or winrm communicator"))
+	}
+
+	if c.VirtioContainerImage != "" && c.VirtioClaimName != "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("only one of virtio_container_image or virtio_claim_name can be set"))
+	}
+
+	if ci := c.CloudInit; ci != nil {
+		if ci.Type != "NoCloud" && ci.Type != "ConfigDrive" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("cloud_init: type %q is not supported, set 'NoCloud' or 'ConfigDrive'", ci.Type))
+		}
+		if ci.UserData != "" && ci.UserDataSecretRef != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("cloud_init: only one of user_data or user_data_secret_ref can be defined"))
+		}
+		if ci.NetworkData != "" && ci.NetworkDataSecretRef != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("cloud_init: only one of network_data or network_data_secret_ref can be defined"))
+		}
+		if ci.UserData == "" && ci.UserDataSecretRef == "" && ci.NetworkData == "" && ci.NetworkDataSecretRef == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("cloud_init: at least one of user data or network data must be defined"))
+		}
+		if md := ci.MetaData; md != nil {
+			if md.LocalHostname != "" {
+				if msgs := validation.IsDNS1123Label(md.LocalHostname); len(msgs) > 0 {
+					errs = packer.MultiErrorAppend(errs, fmt.Errorf("cloud_init: local_hostname %q is not valid: %s", md.LocalHostname, strings.Join(msgs, ", ")))
+				}
+			}
+			if md.PublicKeysSecretRef != "" && ci.Type != "ConfigDrive" {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("cloud_init: public_keys_secret_ref is only supported by the ConfigDrive data source"))
+			}
+		}
+
+		// cloud-init would read the media CD-ROM as a NoCloud data source as well.
+		if profile, err := c.osProfile(); err == nil && ci.Type == "NoCloud" &&
+			(profile.Media == "" || profile.Media == "cdrom") && strings.EqualFold(c.mediaVolumeLabel(), "cidata") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("cloud_init: the NoCloud data source cannot be used along with the media CD-ROM labelled %q, use ConfigDrive instead", c.mediaVolumeLabel()))
+		}
+	}
+
+	if ig := c.Ignition; ig != nil {
+		if err := prepareIgnition(ig); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("ignition: %w", err))
+		}
+	}
+
+	if _, err := affinity(c.Affinity); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("invalid affinity: %w", err))
+	}
+
+	for i, t := range c.Tolerations {
+		if err := validateToleration(t); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("toleration %d: %w", i, err))
+		}
+	}
+
+	switch v1.EvictionStrategy(c.EvictionStrategy) {
+	case "", v1.EvictionStrategyNone, v1.EvictionStrategyLiveMigrate,
+		v1.EvictionStrategyLiveMigrateIfPossible, v1.EvictionStrategyExternal:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("eviction strategy %q is not supported", c.EvictionStrategy))
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"boot_wait", c.BootWait},
+		{"installation_wait_timeout", c.InstallationWaitTimeout},
+		{"seal_timeout", c.SealTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"build_lease_ttl", c.BuildLeaseTTL},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("%s must not be negative", d.key))
+		}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return nil, errs
+	}
+	return nil, nil
+}
+
+// applyDefaults sets the documented defaults of the unset fields.
+func (c *Config) applyDefaults() {
+	if c.OperatingSystemType == "" {
+		c.OperatingSystemType = "linux"
+	}
+	if c.InstanceTypeKind == "" {
+		c.InstanceTypeKind = instancetypeapi.ClusterSingularResourceName
+	}
+	if c.PreferenceKind == "" {
+		c.PreferenceKind = instancetypeapi.ClusterSingularPreferenceResourceName
+	}
+	if c.VirtioContainerImage == "" && c.VirtioClaimName == "" {
+		c.VirtioContainerImage = defaultVirtioContainerImage
+	}
+	if c.CustomizeImage == "" {
+		c.CustomizeImage = defaultCustomizeImage
+	}
+	if c.SealTimeout == 0 {
+		c.SealTimeout = 30 * time.Minute
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 5 * time.Minute
+	}
+	if c.BuildLeaseTTL == 0 {
+		c.BuildLeaseTTL = 24 * time.Hour
+	}
+	if c.SSHRemotePort == 0 {
+		c.SSHRemotePort = 22
+	}
+	if c.WinRMRemotePort == 0 {
+		c.WinRMRemotePort = 5985
+	}
+
+	for i := range c.Networks {
+		if c.Networks[i].Pod == nil && c.Networks[i].Multus == nil {
+			c.Networks[i].Pod = &PodNetwork{}
+		}
+	}
+	for i := range c.Disks {
+		if c.Disks[i].Type == "" {
+			c.Disks[i].Type = "disk"
+		}
+	}
+	for i := range c.Tolerations {
+		if c.Tolerations[i].Operator == "" {
+			c.Tolerations[i].Operator = string(corev1.TolerationOpEqual)
+		}
+	}
+	if ci := c.CloudInit; ci != nil && ci.Type == "" {
+		ci.Type = "NoCloud"
+	}
+	if t := c.VirtualMachineTemplate; t != nil {
+		if t.Kind == "" {
+			t.Kind = "VirtualMachine"
+		}
+		if t.Name == "" {
+			t.Name = c.Name
+		}
+	}
+}
+
+// validateCommunicator checks the communicator type and the ports used to connect to the VM.
+func (c *Config) validateCommunicator() []error {
+	var errs []error
+
+	switch c.Communicator {
+	case "", "none":
+	case "ssh":
+		if c.SSHLocalPort == 0 {
+			errs = append(errs, fmt.Errorf("ssh_local_port must be set with the ssh communicator"))
+		}
+	case "winrm":
+		if c.WinRMLocalPort == 0 {
+			errs = append(errs, fmt.Errorf("winrm_local_port must be set with the winrm communicator"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("communicator %q is not supported, set 'ssh', 'winrm' or 'none'", c.Communicator))
+	}
+
+	ports := []struct {
+		key   string
+		value int
+	}{
+		{"ssh_local_port", c.SSHLocalPort},
+		{"ssh_remote_port", c.SSHRemotePort},
+		{"winrm_local_port", c.WinRMLocalPort},
+		{"winrm_remote_port", c.WinRMRemotePort},
+	}
+	for _, p := range ports {
+		if p.value == 0 {
+			continue
+		}
+		if msgs := validation.IsValidPortNum(p.value); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("%s %d is not valid: %s", p.key, p.value, strings.Join(msgs, ", ")))
+		}
+	}
+	return errs
+}
+
+// validateMediaPath checks that the path of a media file is relative to the root of the media.
+func validateMediaPath(relPath string) error {
+	slashPath := filepath.ToSlash(relPath)
+	if slashPath == "" || path.IsAbs(slashPath) || filepath.IsAbs(relPath) {
+		return fmt.Errorf("path %q must be relative to the root of the media", relPath)
+	}
+	if slices.Contains(strings.Split(slashPath, "/"), "..") {
+		return fmt.Errorf("path %q must not contain \"..\"", relPath)
+	}
+	return nil
+}
+
+// linuxSealCommand clears the machine-id, the SSH host keys and the cloud-init state,
+// so they are regenerated on the first boot of VMs created from the image.
+const linuxSealCommand = "sudo sh -c 'truncate -s 0 /etc/machine-id && rm -f /var/lib/dbus/machine-id /etc/ssh/ssh_host_* && " +
+	"if command -v cloud-init >/dev/null; then cloud-init clean --logs; fi && shutdown -P now'"
+
+// linuxTrimCommand discards the unused blocks of all the mounted filesystems that support it.
+const linuxTrimCommand = "sudo fstrim --all --verbose"
+
+// osProfiles are the built-in OS profiles, selected by os_type.
+var osProfiles = map[string]OSProfile{
+	"linux": {
+		Media:            "cdrom",
+		MediaVolumeLabel: "OEMDRV",
+		Communicator:     "ssh",
+		ShutdownCommand:  "sudo shutdown -P now",
+		SealCommand:      linuxSealCommand,
+		TrimCommand:      linuxTrimCommand,
+	},
+	"windows": {
+		CDRomBus:        "sata",
+		Media:           "sysprep",
+		VirtioDrivers:   true,
+		Communicator:    "winrm",
+		ShutdownCommand: `shutdown /s /t 10 /f /d p:4:1 /c "Packer Shutdown"`,
+		SealCommand:     `C:\Windows\System32\Sysprep\sysprep.exe /generalize /oobe /shutdown /quiet`,
+		TrimCommand:     `powershell -NoProfile -Command "Get-Volume | Where-Object DriveLetter | Optimize-Volume -ReTrim"`,
+	},
+	"ubuntu-autoinstall": {
+		Media:            "cdrom",
+		MediaVolumeLabel: "cidata",
+		Communicator:     "ssh",
+		ShutdownCommand:  "sudo shutdown -P now",
+		SealCommand:      linuxSealCommand,
+		TrimCommand:      linuxTrimCommand,
+	},
+	"coreos": {
+		Media:           "none",
+		Communicator:    "ssh",
+		ShutdownCommand: "sudo shutdown -P now",
+		SealCommand:     linuxSealCommand,
+		TrimCommand:     linuxTrimCommand,
+	},
+	"freebsd": {
+		CDRomBus:        "sata",
+		DiskBus:         "sata",
+		Media:           "cdrom",
+		Communicator:    "ssh",
+		ShutdownCommand: "sudo shutdown -p now",
+		SealCommand:     "sudo sh -c 'rm -f /etc/ssh/ssh_host_* && shutdown -p now'",
+	},
+}
+
+// osProfile returns the OS profile selected by os_type.
+func (c *Config) osProfile() (OSProfile, error) {
+	osType := c.OperatingSystemType
+	if osType == "" {
+		osType = "linux"
+	}
+
+	if osType == "custom" {
+		if c.OSProfile == nil {
+			return OSProfile{}, fmt.Errorf("os_profile must be set if os_type is 'custom'")
+		}
+		return *c.OSProfile, nil
+	}
+
+	profile, ok := osProfiles[osType]
+	if !ok {
+		return OSProfile{}, fmt.Errorf("OS type of '%s' is not supported, set 'linux', 'windows', 'ubuntu-autoinstall', 'coreos', 'freebsd' or 'custom'", osType)
+	}
+	return profile, nil
+}
+
+// shutdownCommand returns the command to gracefully shut down the guest.
+func (c *Config) shutdownCommand() string {
+	if c.ShutdownCommand != "" {
+		return c.ShutdownCommand
+	}
+
+	if profile, err := c.osProfile(); err == nil {
+		return c.sudoCommand(profile.ShutdownCommand)
+	}
+	return ""
+}
+
+// sudoCommand runs the command of an OS profile with a sudo reading the SSH password from its
+// standard input, since no TTY is allocated for sudo to prompt for it, see remoteCmd. Without a
+// password, sudo is run non-interactively so that it fails right away if a password is required.
+func (c *Config) sudoCommand(command string) string {
+	rest, ok := strings.CutPrefix(command, "sudo ")
+	if !ok {
+		return command
+	}
+
+	if c.SSHPassword == "" {
+		return "sudo -n " + rest
+	}
+	return "sudo -S -p '' " + rest
+}
+
+// remoteCmd returns the remote command running the given command. The SSH password is written
+// to the standard input of commands starting with "sudo -S", rather than to the command line,
+// which is logged and visible to the processes of the guest.
+func (c *Config) remoteCmd(command string) *packer.RemoteCmd {
+	cmd := &packer.RemoteCmd{Command: command}
+	if strings.HasPrefix(command, "sudo -S ") {
+		cmd.Stdin = strings.NewReader(c.SSHPassword + "\n")
+	}
+	return cmd
+}
+
+// readSSHKeyPair reads the key pair to connect via SSH from ssh_private_key_file.
+func (c *Config) readSSHKeyPair() error {
+	data, err := os.ReadFile(c.SSHPrivateKeyFile)
+	if err != nil {
+		return err
+	}
+
+	keyPair, err := packerssh.KeyPairFromPrivateKey(packerssh.FromPrivateKeyConfig{RawPrivateKeyPemBlock: data})
+	if err != nil {
+		return err
+	}
+	c.sshKeyPair = &keyPair
+	return nil
+}
+
+// sshPublicKey returns the public key to connect via SSH as an authorized_keys line,
+// or an empty string without a key pair.
+func (c *Config) sshPublicKey() string {
+	if c.sshKeyPair == nil {
+		return ""
+	}
+	return strings.TrimSpace(string(c.sshKeyPair.PublicKeyAuthorizedKeysLine))
+}
+
+// outputDiskSize returns the size of the published root disk volume,
+// or disk_size if it is "minimal", until the size of the partitions is known.
+func (c *Config) outputDiskSize() string {
+	if c.OutputDiskSize == "" || c.OutputDiskSize == "minimal" {
+		return c.DiskSize
+	}
+	return c.OutputDiskSize
+}
+
+// shrinkDisk returns whether the root disk is copied into a smaller volume before it is published.
+func (c *Config) shrinkDisk() bool {
+	if c.OutputDiskSize == "minimal" {
+		return true
+	}
+	if c.OutputDiskSize == "" {
+		return false
+	}
+
+	outputSize, err := resource.ParseQuantity(c.OutputDiskSize)
+	if err != nil {
+		return false
+	}
+	diskSize, err := resource.ParseQuantity(c.DiskSize)
+	if err != nil {
+		return false
+	}
+	return outputSize.Cmp(diskSize) < 0
+}
+
+// trimCommand returns the command to discard the unused blocks of the guest filesystems.
+func (c *Config) trimCommand() string {
+	if profile, err := c.osProfile(); err == nil {
+		return c.sudoCommand(profile.TrimCommand)
+	}
+	return ""
+}
+
+// customizeCommands returns the commands run against the root disk of the stopped VM.
+func (c *Config) customizeCommands() []string {
+	commands := c.CustomizeCommands
+	if c.Sparsify {
+		commands = append(commands[:len(commands):len(commands)], "virt-sparsify --in-place $DISK")
+	}
+	return commands
+}
+
+// sealCommand returns the command to generalize the guest.
+func (c *Config) sealCommand() string {
+	if c.SealCommand != "" {
+		return c.SealCommand
+	}
+
+	if profile, err := c.osProfile(); err == nil {
+		return c.sudoCommand(profile.SealCommand)
+	}
+	return ""
+}
+
+// buildIDLength is the length of the random build ID appended to the name by Builder.Run.
+const buildIDLength = 5
+
+// maxNameLength returns the maximum length of the name, so that the names of the temporary
+// resources, which append the build ID and a suffix to it, are valid DNS-1123 labels.
+func (c *Config) maxNameLength() int {
+	suffixes := []string{"-lease", "-customize", "-measure", "-shrink"}
+	for _, diskName := range []string{"root", "iso", "media", "output"} {
+		suffixes = append(suffixes, diskVolumeName("", diskName))
+	}
+	for _, d := range c.Disks {
+		suffixes = append(suffixes, diskVolumeName("", d.Name))
+	}
+
+	longest := 0
+	for _, suffix := range suffixes {
+		longest = max(longest, len(suffix))
+	}
+	return validation.DNS1123LabelMaxLength - len("-") - buildIDLength - longest
+}
+
+// buildName returns the name of the temporary VM, from which the names of its volumes,
+// ConfigMap, Secret and Pods are derived. Only the published image is named after Name.
+func (c *Config) buildName() string {
+	if c.buildID == "" {
+		return c.Name
+	}
+	return c.Name + "-" + c.buildID
+}
+
+// force returns whether to replace the published image if it already exists.
+func (c *Config) force() bool {
+	return c.Force || c.PackerForce
+}
+
+// outputNames returns the names of the DataSources of the published image,
+// of the root disk and of each exported disk.
+func (c *Config) outputNames() []string {
+	names := []string{c.Name}
+	for _, d := range c.Disks {
+		if d.Output {
+			names = append(names, c.Name+"-"+d.Name)
+		}
+	}
+	return names
+}
+
+// templateName returns the name of the VirtualMachine or Template created from the image.
+func (c *Config) templateName() string {
+	if c.VirtualMachineTemplate != nil && c.VirtualMachineTemplate.Name != "" {
+		return c.VirtualMachineTemplate.Name
+	}
+	return c.Name
+}
+
+// keepResources returns whether to keep the temporary resources once the build is done.
+func (c *Config) keepResources(failed bool) bool {
+	if c.KeepVM {
+		return true
+	}
+	if failed {
+		return c.KeepOnFailure
+	}
+	return c.KeepOnSuccess
+}
+
+// isoNamespace returns the namespace of the ISO DataVolume.
+func (c *Config) isoNamespace() string {
+	if c.IsoNamespace != "" {
+		return c.IsoNamespace
+	}
+	return c.Namespace
+}
+
+// buildNamespace returns the namespace of the temporary VM and its resources.
+func (c *Config) buildNamespace() string {
+	if c.BuildNamespace != "" {
+		return c.BuildNamespace
+	}
+	return c.Namespace
+}
+
+// outputNamespace returns the namespace of the published image.
+func (c *Config) outputNamespace() string {
+	if c.OutputNamespace != "" {
+		return c.OutputNamespace
+	}
+	return c.Namespace
+}
+
+// mediaVolumeLabel returns the volume label of the media CD-ROM.
+func (c *Config) mediaVolumeLabel() string {
+	if c.MediaVolumeLabel != "" {
+		return c.MediaVolumeLabel
+	}
+
+	if profile, err := c.osProfile(); err == nil && profile.MediaVolumeLabel != "" {
+		return profile.MediaVolumeLabel
+	}
+	return "OEMDRV"
+}
+
+// outputDefaults returns the names of the instance type and preference
+// that VMs created from the image default to.
+func (c *Config) outputDefaults() (string, string) {
+	instanceType := c.DefaultInstanceType
+	preference := c.DefaultPreference
+
+	if instanceType == "" {
+		instanceType = c.InstanceType
+	}
+
+	if preference == "" {
+		preference = c.Preference
+	}
+	return instanceType, preference
+}
+
+func validateDisk(d Disk) error {
+	if d.Name == "" {
+		return fmt.Errorf("name must be set")
+	}
+
+	if msgs := validation.IsDNS1123Label(d.Name); len(msgs) > 0 {
+		return fmt.Errorf("name is not valid: %s", strings.Join(msgs, ", "))
+	}
+
+	if d.Type != "" && d.Type != "disk" && d.Type != "cdrom" {
+		return fmt.Errorf("type %q is not supported, set 'disk' or 'cdrom'", d.Type)
+	}
+
+	if d.BootOrder < 0 {
+		return fmt.Errorf("boot order %d must be greater than zero", d.BootOrder)
+	}
+
+	sources := 0
+	if d.Blank != nil {
+		sources++
+		if _, err := parsePositiveQuantity(d.Blank.Size); err != nil {
+			return fmt.Errorf("blank size: %w", err)
+		}
+	}
+	if d.PersistentVolumeClaim != nil {
+		sources++
+	}
+	if d.Secret != nil {
+		sources++
+	}
+	if d.ContainerDisk != nil {
+		sources++
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of blank, persistentVolumeClaim, secret or containerDisk must be defined")
+	}
+
+	if d.Output && d.Blank == nil {
+		return fmt.Errorf("only blank disks can be exported")
+	}
+	return nil
+}
+
+// validateNetworks checks that the networks have unique and valid names, and that exactly one
+// of them is the default network of the VM: the pod network, or a multus network set as default.
+func validateNetworks(networks []Network) []error {
+	if len(networks) == 0 {
+		return nil
+	}
+
+	var errs []error
+	names := map[string]bool{}
+	defaults := 0
+	for _, n := range networks {
+		if n.Name == "" {
+			errs = append(errs, fmt.Errorf("network: name must be set"))
+		} else if msgs := validation.IsDNS1123Label(n.Name); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("network %q: name is not valid: %s", n.Name, strings.Join(msgs, ", ")))
+		} else if names[n.Name] {
+			errs = append(errs, fmt.Errorf("network %q: name is already in use", n.Name))
+		}
+		names[n.Name] = true
+
 		if n.Pod != nil && n.Multus != nil {
-			return nil, fmt.Errorf("network %q: only one of pod or multus can be defined", n.Name)
+			errs = append(errs, fmt.Errorf("network %q: only one of pod or multus can be defined", n.Name))
+			continue
 		}
+
+		if n.Multus != nil && n.Multus.NetworkName == "" {
+			errs = append(errs, fmt.Errorf("network %q: multus networkName must be set", n.Name))
+		}
+
+		if n.Pod != nil || (n.Multus != nil && n.Multus.Default) {
+			defaults++
+		}
+	}
+
+	if defaults != 1 {
+		errs = append(errs, fmt.Errorf("exactly one network must be the default network, "+
+			"either the pod network or a multus network set as default, found %d", defaults))
+	}
+	return errs
+}
+
+// validateToleration checks the operator and effect of a toleration.
+func validateToleration(t Toleration) error {
+	switch corev1.TolerationOperator(t.Operator) {
+	case corev1.TolerationOpEqual:
+		if t.Key == "" {
+			return fmt.Errorf("operator must be %q if the key is empty", corev1.TolerationOpExists)
+		}
+	case corev1.TolerationOpExists:
+		if t.Value != "" {
+			return fmt.Errorf("value must be empty if the operator is %q", corev1.TolerationOpExists)
+		}
+	default:
+		return fmt.Errorf("operator %q is not supported, set 'Exists' or 'Equal'", t.Operator)
+	}
+
+	switch corev1.TaintEffect(t.Effect) {
+	case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return fmt.Errorf("effect %q is not supported, set 'NoSchedule', 'PreferNoSchedule' or 'NoExecute'", t.Effect)
+	}
+	return nil
+}
+
+// prepareIgnition reads the Ignition config from its file, if set, and checks it is valid JSON.
+func prepareIgnition(ig *Ignition) error {
+	if (ig.Config == "") == (ig.File == "") {
+		return fmt.Errorf("exactly one of config or file must be defined")
+	}
+	if ig.File != "" {
+		content, err := os.ReadFile(ig.File)
+		if err != nil {
+			return err
+		}
+		ig.Config = string(content)
+	}
+	if !json.Valid([]byte(ig.Config)) {
+		return fmt.Errorf("config is not valid JSON")
+	}
+	return nil
+}
+
+// parsePositiveQuantity parses a resource quantity, e.g. "20Gi", which must be greater than zero.
+func parsePositiveQuantity(value string) (*resource.Quantity, error) {
+	if value == "" {
+		return nil, fmt.Errorf("must be set")
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid quantity, e.g. \"20Gi\": %w", value, err)
+	}
+	if quantity.Sign() <= 0 {
+		return nil, fmt.Errorf("%q must be greater than zero", value)
 	}
-	return nil, err
+	return &quantity, nil
 }
@@ -7,46 +7,171 @@ import (
 	"github.com/zclconf/go-cty/cty"
 )
 
+// FlatBlankVolume is an auto-generated flat version of BlankVolume.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatBlankVolume struct {
+	Size *string `mapstructure:"size" cty:"size" hcl:"size"`
+}
+
+// FlatMapstructure returns a new FlatBlankVolume.
+// FlatBlankVolume is an auto-generated flat version of BlankVolume.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*BlankVolume) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatBlankVolume)
+}
+
+// HCL2Spec returns the hcl spec of a BlankVolume.
+// This spec is used by HCL to read the fields of BlankVolume.
+// The decoded values from this spec will then be applied to a FlatBlankVolume.
+func (*FlatBlankVolume) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"size": &hcldec.AttrSpec{Name: "size", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatCloudInit is an auto-generated flat version of CloudInit.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatCloudInit struct {
+	Type                 *string                `mapstructure:"type,omitempty" cty:"type" hcl:"type"`
+	UserData             *string                `mapstructure:"user_data,omitempty" cty:"user_data" hcl:"user_data"`
+	UserDataSecretRef    *string                `mapstructure:"user_data_secret_ref,omitempty" cty:"user_data_secret_ref" hcl:"user_data_secret_ref"`
+	NetworkData          *string                `mapstructure:"network_data,omitempty" cty:"network_data" hcl:"network_data"`
+	NetworkDataSecretRef *string                `mapstructure:"network_data_secret_ref,omitempty" cty:"network_data_secret_ref" hcl:"network_data_secret_ref"`
+	MetaData             *FlatCloudInitMetaData `mapstructure:"meta_data,omitempty" cty:"meta_data" hcl:"meta_data"`
+}
+
+// FlatMapstructure returns a new FlatCloudInit.
+// FlatCloudInit is an auto-generated flat version of CloudInit.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*CloudInit) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatCloudInit)
+}
+
+// HCL2Spec returns the hcl spec of a CloudInit.
+// This spec is used by HCL to read the fields of CloudInit.
+// The decoded values from this spec will then be applied to a FlatCloudInit.
+func (*FlatCloudInit) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"type":                    &hcldec.AttrSpec{Name: "type", Type: cty.String, Required: false},
+		"user_data":               &hcldec.AttrSpec{Name: "user_data", Type: cty.String, Required: false},
+		"user_data_secret_ref":    &hcldec.AttrSpec{Name: "user_data_secret_ref", Type: cty.String, Required: false},
+		"network_data":            &hcldec.AttrSpec{Name: "network_data", Type: cty.String, Required: false},
+		"network_data_secret_ref": &hcldec.AttrSpec{Name: "network_data_secret_ref", Type: cty.String, Required: false},
+		"meta_data":               &hcldec.BlockSpec{TypeName: "meta_data", Nested: hcldec.ObjectSpec((*FlatCloudInitMetaData)(nil).HCL2Spec())},
+	}
+	return s
+}
+
+// FlatCloudInitMetaData is an auto-generated flat version of CloudInitMetaData.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatCloudInitMetaData struct {
+	LocalHostname       *string `mapstructure:"local_hostname,omitempty" cty:"local_hostname" hcl:"local_hostname"`
+	PublicKeysSecretRef *string `mapstructure:"public_keys_secret_ref,omitempty" cty:"public_keys_secret_ref" hcl:"public_keys_secret_ref"`
+}
+
+// FlatMapstructure returns a new FlatCloudInitMetaData.
+// FlatCloudInitMetaData is an auto-generated flat version of CloudInitMetaData.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*CloudInitMetaData) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatCloudInitMetaData)
+}
+
+// HCL2Spec returns the hcl spec of a CloudInitMetaData.
+// This spec is used by HCL to read the fields of CloudInitMetaData.
+// The decoded values from this spec will then be applied to a FlatCloudInitMetaData.
+func (*FlatCloudInitMetaData) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"local_hostname":         &hcldec.AttrSpec{Name: "local_hostname", Type: cty.String, Required: false},
+		"public_keys_secret_ref": &hcldec.AttrSpec{Name: "public_keys_secret_ref", Type: cty.String, Required: false},
+	}
+	return s
+}
+
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	PackerBuildName         *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
-	PackerBuilderType       *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
-	PackerCoreVersion       *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
-	PackerDebug             *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
-	PackerForce             *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
-	PackerOnError           *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
-	PackerUserVars          map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
-	PackerSensitiveVars     []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
-	KubeConfig              *string           `mapstructure:"kube_config" required:"true" cty:"kube_config" hcl:"kube_config"`
-	Name                    *string           `mapstructure:"name" required:"true" cty:"name" hcl:"name"`
-	Namespace               *string           `mapstructure:"namespace" required:"true" cty:"namespace" hcl:"namespace"`
-	IsoVolumeName           *string           `mapstructure:"iso_volume_name" required:"true" cty:"iso_volume_name" hcl:"iso_volume_name"`
-	DiskSize                *string           `mapstructure:"disk_size" required:"true" cty:"disk_size" hcl:"disk_size"`
-	InstanceType            *string           `mapstructure:"instance_type" required:"true" cty:"instance_type" hcl:"instance_type"`
-	InstanceTypeKind        *string           `mapstructure:"instance_type_kind" required:"false" cty:"instance_type_kind" hcl:"instance_type_kind"`
-	Preference              *string           `mapstructure:"preference" required:"true" cty:"preference" hcl:"preference"`
-	PreferenceKind          *string           `mapstructure:"preference_kind" required:"false" cty:"preference_kind" hcl:"preference_kind"`
-	OperatingSystemType     *string           `mapstructure:"os_type" required:"false" cty:"os_type" hcl:"os_type"`
-	Networks                []FlatNetwork     `mapstructure:"networks" required:"false" cty:"networks" hcl:"networks"`
-	MediaFiles              []string          `mapstructure:"media_files" required:"false" cty:"media_files" hcl:"media_files"`
-	BootCommand             []string          `mapstructure:"boot_command" required:"false" cty:"boot_command" hcl:"boot_command"`
-	BootWait                *string           `mapstructure:"boot_wait" required:"false" cty:"boot_wait" hcl:"boot_wait"`
-	InstallationWaitTimeout *string           `mapstructure:"installation_wait_timeout" required:"true" cty:"installation_wait_timeout" hcl:"installation_wait_timeout"`
-	Communicator            *string           `mapstructure:"communicator" required:"false" cty:"communicator" hcl:"communicator"`
-	SSHHost                 *string           `mapstructure:"ssh_host" required:"false" cty:"ssh_host" hcl:"ssh_host"`
-	SSHLocalPort            *int              `mapstructure:"ssh_local_port" required:"false" cty:"ssh_local_port" hcl:"ssh_local_port"`
-	SSHRemotePort           *int              `mapstructure:"ssh_remote_port" required:"false" cty:"ssh_remote_port" hcl:"ssh_remote_port"`
-	SSHUsername             *string           `mapstructure:"ssh_username" required:"false" cty:"ssh_username" hcl:"ssh_username"`
-	SSHPassword             *string           `mapstructure:"ssh_password" required:"false" cty:"ssh_password" hcl:"ssh_password"`
-	SSHWaitTimeout          *string           `mapstructure:"ssh_wait_timeout" required:"false" cty:"ssh_wait_timeout" hcl:"ssh_wait_timeout"`
-	WinRMHost               *string           `mapstructure:"winrm_host" required:"false" cty:"winrm_host" hcl:"winrm_host"`
-	WinRMLocalPort          *int              `mapstructure:"winrm_local_port" required:"false" cty:"winrm_local_port" hcl:"winrm_local_port"`
-	WinRMRemotePort         *int              `mapstructure:"winrm_remote_port" required:"false" cty:"winrm_remote_port" hcl:"winrm_remote_port"`
-	WinRMUsername           *string           `mapstructure:"winrm_username" required:"false" cty:"winrm_username" hcl:"winrm_username"`
-	WinRMPassword           *string           `mapstructure:"winrm_password" required:"false" cty:"winrm_password" hcl:"winrm_password"`
-	WinRMWaitTimeout        *string           `mapstructure:"winrm_wait_timeout" required:"false" cty:"winrm_wait_timeout" hcl:"winrm_wait_timeout"`
-	KeepVM                  *bool             `mapstructure:"keep_vm" required:"false" cty:"keep_vm" hcl:"keep_vm"`
+	PackerBuildName         *string                     `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType       *string                     `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion       *string                     `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug             *bool                       `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce             *bool                       `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError           *string                     `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars          map[string]string           `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars     []string                    `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	KubeConfig              *string                     `mapstructure:"kube_config" required:"true" cty:"kube_config" hcl:"kube_config"`
+	Name                    *string                     `mapstructure:"name" required:"true" cty:"name" hcl:"name"`
+	Namespace               *string                     `mapstructure:"namespace" required:"true" cty:"namespace" hcl:"namespace"`
+	IsoNamespace            *string                     `mapstructure:"iso_namespace" required:"false" cty:"iso_namespace" hcl:"iso_namespace"`
+	BuildNamespace          *string                     `mapstructure:"build_namespace" required:"false" cty:"build_namespace" hcl:"build_namespace"`
+	OutputNamespace         *string                     `mapstructure:"output_namespace" required:"false" cty:"output_namespace" hcl:"output_namespace"`
+	IsoVolumeName           *string                     `mapstructure:"iso_volume_name" required:"true" cty:"iso_volume_name" hcl:"iso_volume_name"`
+	DiskSize                *string                     `mapstructure:"disk_size" required:"true" cty:"disk_size" hcl:"disk_size"`
+	OutputDiskSize          *string                     `mapstructure:"output_disk_size" required:"false" cty:"output_disk_size" hcl:"output_disk_size"`
+	Sparsify                *bool                       `mapstructure:"sparsify" required:"false" cty:"sparsify" hcl:"sparsify"`
+	Fstrim                  *bool                       `mapstructure:"fstrim" required:"false" cty:"fstrim" hcl:"fstrim"`
+	InstanceType            *string                     `mapstructure:"instance_type" required:"false" cty:"instance_type" hcl:"instance_type"`
+	InstanceTypeKind        *string                     `mapstructure:"instance_type_kind" required:"false" cty:"instance_type_kind" hcl:"instance_type_kind"`
+	Preference              *string                     `mapstructure:"preference" required:"false" cty:"preference" hcl:"preference"`
+	PreferenceKind          *string                     `mapstructure:"preference_kind" required:"false" cty:"preference_kind" hcl:"preference_kind"`
+	CPU                     *int                        `mapstructure:"cpu" required:"false" cty:"cpu" hcl:"cpu"`
+	Memory                  *string                     `mapstructure:"memory" required:"false" cty:"memory" hcl:"memory"`
+	MachineType             *string                     `mapstructure:"machine_type" required:"false" cty:"machine_type" hcl:"machine_type"`
+	DefaultInstanceType     *string                     `mapstructure:"default_instance_type" required:"false" cty:"default_instance_type" hcl:"default_instance_type"`
+	DefaultPreference       *string                     `mapstructure:"default_preference" required:"false" cty:"default_preference" hcl:"default_preference"`
+	OperatingSystemType     *string                     `mapstructure:"os_type" required:"false" cty:"os_type" hcl:"os_type"`
+	OSProfile               *FlatOSProfile              `mapstructure:"os_profile" required:"false" cty:"os_profile" hcl:"os_profile"`
+	VirtioContainerImage    *string                     `mapstructure:"virtio_container_image" required:"false" cty:"virtio_container_image" hcl:"virtio_container_image"`
+	VirtioClaimName         *string                     `mapstructure:"virtio_claim_name" required:"false" cty:"virtio_claim_name" hcl:"virtio_claim_name"`
+	DisableVirtioDrivers    *bool                       `mapstructure:"disable_virtio_drivers" required:"false" cty:"disable_virtio_drivers" hcl:"disable_virtio_drivers"`
+	Networks                []FlatNetwork               `mapstructure:"networks" required:"false" cty:"networks" hcl:"networks"`
+	Disks                   []FlatDisk                  `mapstructure:"disks" required:"false" cty:"disks" hcl:"disks"`
+	NodeSelector            map[string]string           `mapstructure:"node_selector" required:"false" cty:"node_selector" hcl:"node_selector"`
+	Tolerations             []FlatToleration            `mapstructure:"tolerations" required:"false" cty:"tolerations" hcl:"tolerations"`
+	Affinity                *string                     `mapstructure:"affinity" required:"false" cty:"affinity" hcl:"affinity"`
+	PriorityClassName       *string                     `mapstructure:"priority_class_name" required:"false" cty:"priority_class_name" hcl:"priority_class_name"`
+	EvictionStrategy        *string                     `mapstructure:"eviction_strategy" required:"false" cty:"eviction_strategy" hcl:"eviction_strategy"`
+	MediaFiles              []string                    `mapstructure:"media_files" required:"false" cty:"media_files" hcl:"media_files"`
+	MediaContent            map[string]string           `mapstructure:"media_content" required:"false" cty:"media_content" hcl:"media_content"`
+	MediaTemplates          []string                    `mapstructure:"media_templates" required:"false" cty:"media_templates" hcl:"media_templates"`
+	MediaVolumeLabel        *string                     `mapstructure:"media_volume_label" required:"false" cty:"media_volume_label" hcl:"media_volume_label"`
+	MediaFilesSecret        *bool                       `mapstructure:"media_files_secret" required:"false" cty:"media_files_secret" hcl:"media_files_secret"`
+	MediaFilesISO           *bool                       `mapstructure:"media_files_iso" required:"false" cty:"media_files_iso" hcl:"media_files_iso"`
+	MediaUploadProxyURL     *string                     `mapstructure:"media_upload_proxy_url" required:"false" cty:"media_upload_proxy_url" hcl:"media_upload_proxy_url"`
+	MediaUploadInsecure     *bool                       `mapstructure:"media_upload_insecure" required:"false" cty:"media_upload_insecure" hcl:"media_upload_insecure"`
+	BootCommand             []string                    `mapstructure:"boot_command" required:"false" cty:"boot_command" hcl:"boot_command"`
+	BootWait                *string                     `mapstructure:"boot_wait" required:"false" cty:"boot_wait" hcl:"boot_wait"`
+	InstallationWaitTimeout *string                     `mapstructure:"installation_wait_timeout" required:"true" cty:"installation_wait_timeout" hcl:"installation_wait_timeout"`
+	ShutdownCommand         *string                     `mapstructure:"shutdown_command" required:"false" cty:"shutdown_command" hcl:"shutdown_command"`
+	CustomizeCommands       []string                    `mapstructure:"customize_commands" required:"false" cty:"customize_commands" hcl:"customize_commands"`
+	CustomizeImage          *string                     `mapstructure:"customize_image" required:"false" cty:"customize_image" hcl:"customize_image"`
+	Seal                    *bool                       `mapstructure:"seal" required:"false" cty:"seal" hcl:"seal"`
+	SealCommand             *string                     `mapstructure:"seal_command" required:"false" cty:"seal_command" hcl:"seal_command"`
+	SealTimeout             *string                     `mapstructure:"seal_timeout" required:"false" cty:"seal_timeout" hcl:"seal_timeout"`
+	ShutdownTimeout         *string                     `mapstructure:"shutdown_timeout" required:"false" cty:"shutdown_timeout" hcl:"shutdown_timeout"`
+	Communicator            *string                     `mapstructure:"communicator" required:"false" cty:"communicator" hcl:"communicator"`
+	SSHHost                 *string                     `mapstructure:"ssh_host" required:"false" cty:"ssh_host" hcl:"ssh_host"`
+	SSHLocalPort            *int                        `mapstructure:"ssh_local_port" required:"false" cty:"ssh_local_port" hcl:"ssh_local_port"`
+	SSHRemotePort           *int                        `mapstructure:"ssh_remote_port" required:"false" cty:"ssh_remote_port" hcl:"ssh_remote_port"`
+	SSHUsername             *string                     `mapstructure:"ssh_username" required:"false" cty:"ssh_username" hcl:"ssh_username"`
+	SSHPassword             *string                     `mapstructure:"ssh_password" required:"false" cty:"ssh_password" hcl:"ssh_password"`
+	SSHPrivateKeyFile       *string                     `mapstructure:"ssh_private_key_file" required:"false" cty:"ssh_private_key_file" hcl:"ssh_private_key_file"`
+	SSHWaitTimeout          *string                     `mapstructure:"ssh_wait_timeout" required:"false" cty:"ssh_wait_timeout" hcl:"ssh_wait_timeout"`
+	WinRMHost               *string                     `mapstructure:"winrm_host" required:"false" cty:"winrm_host" hcl:"winrm_host"`
+	WinRMLocalPort          *int                        `mapstructure:"winrm_local_port" required:"false" cty:"winrm_local_port" hcl:"winrm_local_port"`
+	WinRMRemotePort         *int                        `mapstructure:"winrm_remote_port" required:"false" cty:"winrm_remote_port" hcl:"winrm_remote_port"`
+	WinRMUsername           *string                     `mapstructure:"winrm_username" required:"false" cty:"winrm_username" hcl:"winrm_username"`
+	WinRMPassword           *string                     `mapstructure:"winrm_password" required:"false" cty:"winrm_password" hcl:"winrm_password"`
+	WinRMWaitTimeout        *string                     `mapstructure:"winrm_wait_timeout" required:"false" cty:"winrm_wait_timeout" hcl:"winrm_wait_timeout"`
+	CloudInit               *FlatCloudInit              `mapstructure:"cloud_init" required:"false" cty:"cloud_init" hcl:"cloud_init"`
+	Ignition                *FlatIgnition               `mapstructure:"ignition" required:"false" cty:"ignition" hcl:"ignition"`
+	VirtualMachineTemplate  *FlatVirtualMachineTemplate `mapstructure:"vm_template" required:"false" cty:"vm_template" hcl:"vm_template"`
+	KeepOnSuccess           *bool                       `mapstructure:"keep_on_success" required:"false" cty:"keep_on_success" hcl:"keep_on_success"`
+	KeepOnFailure           *bool                       `mapstructure:"keep_on_failure" required:"false" cty:"keep_on_failure" hcl:"keep_on_failure"`
+	KeepVM                  *bool                       `mapstructure:"keep_vm" required:"false" cty:"keep_vm" hcl:"keep_vm"`
+	Force                   *bool                       `mapstructure:"force" required:"false" cty:"force" hcl:"force"`
+	BuildLeaseTTL           *string                     `mapstructure:"build_lease_ttl" required:"false" cty:"build_lease_ttl" hcl:"build_lease_ttl"`
+	CleanupStaleBuilds      *bool                       `mapstructure:"cleanup_stale_builds" required:"false" cty:"cleanup_stale_builds" hcl:"cleanup_stale_builds"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -72,24 +197,60 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"kube_config":                &hcldec.AttrSpec{Name: "kube_config", Type: cty.String, Required: false},
 		"name":                       &hcldec.AttrSpec{Name: "name", Type: cty.String, Required: false},
 		"namespace":                  &hcldec.AttrSpec{Name: "namespace", Type: cty.String, Required: false},
+		"iso_namespace":              &hcldec.AttrSpec{Name: "iso_namespace", Type: cty.String, Required: false},
+		"build_namespace":            &hcldec.AttrSpec{Name: "build_namespace", Type: cty.String, Required: false},
+		"output_namespace":           &hcldec.AttrSpec{Name: "output_namespace", Type: cty.String, Required: false},
 		"iso_volume_name":            &hcldec.AttrSpec{Name: "iso_volume_name", Type: cty.String, Required: false},
 		"disk_size":                  &hcldec.AttrSpec{Name: "disk_size", Type: cty.String, Required: false},
+		"output_disk_size":           &hcldec.AttrSpec{Name: "output_disk_size", Type: cty.String, Required: false},
+		"sparsify":                   &hcldec.AttrSpec{Name: "sparsify", Type: cty.Bool, Required: false},
+		"fstrim":                     &hcldec.AttrSpec{Name: "fstrim", Type: cty.Bool, Required: false},
 		"instance_type":              &hcldec.AttrSpec{Name: "instance_type", Type: cty.String, Required: false},
 		"instance_type_kind":         &hcldec.AttrSpec{Name: "instance_type_kind", Type: cty.String, Required: false},
 		"preference":                 &hcldec.AttrSpec{Name: "preference", Type: cty.String, Required: false},
 		"preference_kind":            &hcldec.AttrSpec{Name: "preference_kind", Type: cty.String, Required: false},
+		"cpu":                        &hcldec.AttrSpec{Name: "cpu", Type: cty.Number, Required: false},
+		"memory":                     &hcldec.AttrSpec{Name: "memory", Type: cty.String, Required: false},
+		"machine_type":               &hcldec.AttrSpec{Name: "machine_type", Type: cty.String, Required: false},
+		"default_instance_type":      &hcldec.AttrSpec{Name: "default_instance_type", Type: cty.String, Required: false},
+		"default_preference":         &hcldec.AttrSpec{Name: "default_preference", Type: cty.String, Required: false},
 		"os_type":                    &hcldec.AttrSpec{Name: "os_type", Type: cty.String, Required: false},
+		"os_profile":                 &hcldec.BlockSpec{TypeName: "os_profile", Nested: hcldec.ObjectSpec((*FlatOSProfile)(nil).HCL2Spec())},
+		"virtio_container_image":     &hcldec.AttrSpec{Name: "virtio_container_image", Type: cty.String, Required: false},
+		"virtio_claim_name":          &hcldec.AttrSpec{Name: "virtio_claim_name", Type: cty.String, Required: false},
+		"disable_virtio_drivers":     &hcldec.AttrSpec{Name: "disable_virtio_drivers", Type: cty.Bool, Required: false},
 		"networks":                   &hcldec.BlockListSpec{TypeName: "networks", Nested: hcldec.ObjectSpec((*FlatNetwork)(nil).HCL2Spec())},
+		"disks":                      &hcldec.BlockListSpec{TypeName: "disks", Nested: hcldec.ObjectSpec((*FlatDisk)(nil).HCL2Spec())},
+		"node_selector":              &hcldec.AttrSpec{Name: "node_selector", Type: cty.Map(cty.String), Required: false},
+		"tolerations":                &hcldec.BlockListSpec{TypeName: "tolerations", Nested: hcldec.ObjectSpec((*FlatToleration)(nil).HCL2Spec())},
+		"affinity":                   &hcldec.AttrSpec{Name: "affinity", Type: cty.String, Required: false},
+		"priority_class_name":        &hcldec.AttrSpec{Name: "priority_class_name", Type: cty.String, Required: false},
+		"eviction_strategy":          &hcldec.AttrSpec{Name: "eviction_strategy", Type: cty.String, Required: false},
 		"media_files":                &hcldec.AttrSpec{Name: "media_files", Type: cty.List(cty.String), Required: false},
+		"media_content":              &hcldec.AttrSpec{Name: "media_content", Type: cty.Map(cty.String), Required: false},
+		"media_templates":            &hcldec.AttrSpec{Name: "media_templates", Type: cty.List(cty.String), Required: false},
+		"media_volume_label":         &hcldec.AttrSpec{Name: "media_volume_label", Type: cty.String, Required: false},
+		"media_files_secret":         &hcldec.AttrSpec{Name: "media_files_secret", Type: cty.Bool, Required: false},
+		"media_files_iso":            &hcldec.AttrSpec{Name: "media_files_iso", Type: cty.Bool, Required: false},
+		"media_upload_proxy_url":     &hcldec.AttrSpec{Name: "media_upload_proxy_url", Type: cty.String, Required: false},
+		"media_upload_insecure":      &hcldec.AttrSpec{Name: "media_upload_insecure", Type: cty.Bool, Required: false},
 		"boot_command":               &hcldec.AttrSpec{Name: "boot_command", Type: cty.List(cty.String), Required: false},
 		"boot_wait":                  &hcldec.AttrSpec{Name: "boot_wait", Type: cty.String, Required: false},
 		"installation_wait_timeout":  &hcldec.AttrSpec{Name: "installation_wait_timeout", Type: cty.String, Required: false},
+		"shutdown_command":           &hcldec.AttrSpec{Name: "shutdown_command", Type: cty.String, Required: false},
+		"customize_commands":         &hcldec.AttrSpec{Name: "customize_commands", Type: cty.List(cty.String), Required: false},
+		"customize_image":            &hcldec.AttrSpec{Name: "customize_image", Type: cty.String, Required: false},
+		"seal":                       &hcldec.AttrSpec{Name: "seal", Type: cty.Bool, Required: false},
+		"seal_command":               &hcldec.AttrSpec{Name: "seal_command", Type: cty.String, Required: false},
+		"seal_timeout":               &hcldec.AttrSpec{Name: "seal_timeout", Type: cty.String, Required: false},
+		"shutdown_timeout":           &hcldec.AttrSpec{Name: "shutdown_timeout", Type: cty.String, Required: false},
 		"communicator":               &hcldec.AttrSpec{Name: "communicator", Type: cty.String, Required: false},
 		"ssh_host":                   &hcldec.AttrSpec{Name: "ssh_host", Type: cty.String, Required: false},
 		"ssh_local_port":             &hcldec.AttrSpec{Name: "ssh_local_port", Type: cty.Number, Required: false},
 		"ssh_remote_port":            &hcldec.AttrSpec{Name: "ssh_remote_port", Type: cty.Number, Required: false},
 		"ssh_username":               &hcldec.AttrSpec{Name: "ssh_username", Type: cty.String, Required: false},
 		"ssh_password":               &hcldec.AttrSpec{Name: "ssh_password", Type: cty.String, Required: false},
+		"ssh_private_key_file":       &hcldec.AttrSpec{Name: "ssh_private_key_file", Type: cty.String, Required: false},
 		"ssh_wait_timeout":           &hcldec.AttrSpec{Name: "ssh_wait_timeout", Type: cty.String, Required: false},
 		"winrm_host":                 &hcldec.AttrSpec{Name: "winrm_host", Type: cty.String, Required: false},
 		"winrm_local_port":           &hcldec.AttrSpec{Name: "winrm_local_port", Type: cty.Number, Required: false},
@@ -97,7 +258,108 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"winrm_username":             &hcldec.AttrSpec{Name: "winrm_username", Type: cty.String, Required: false},
 		"winrm_password":             &hcldec.AttrSpec{Name: "winrm_password", Type: cty.String, Required: false},
 		"winrm_wait_timeout":         &hcldec.AttrSpec{Name: "winrm_wait_timeout", Type: cty.String, Required: false},
+		"cloud_init":                 &hcldec.BlockSpec{TypeName: "cloud_init", Nested: hcldec.ObjectSpec((*FlatCloudInit)(nil).HCL2Spec())},
+		"ignition":                   &hcldec.BlockSpec{TypeName: "ignition", Nested: hcldec.ObjectSpec((*FlatIgnition)(nil).HCL2Spec())},
+		"vm_template":                &hcldec.BlockSpec{TypeName: "vm_template", Nested: hcldec.ObjectSpec((*FlatVirtualMachineTemplate)(nil).HCL2Spec())},
+		"keep_on_success":            &hcldec.AttrSpec{Name: "keep_on_success", Type: cty.Bool, Required: false},
+		"keep_on_failure":            &hcldec.AttrSpec{Name: "keep_on_failure", Type: cty.Bool, Required: false},
 		"keep_vm":                    &hcldec.AttrSpec{Name: "keep_vm", Type: cty.Bool, Required: false},
+		"force":                      &hcldec.AttrSpec{Name: "force", Type: cty.Bool, Required: false},
+		"build_lease_ttl":            &hcldec.AttrSpec{Name: "build_lease_ttl", Type: cty.String, Required: false},
+		"cleanup_stale_builds":       &hcldec.AttrSpec{Name: "cleanup_stale_builds", Type: cty.Bool, Required: false},
+	}
+	return s
+}
+
+// FlatContainerDiskVolume is an auto-generated flat version of ContainerDiskVolume.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatContainerDiskVolume struct {
+	Image           *string `mapstructure:"image" cty:"image" hcl:"image"`
+	ImagePullSecret *string `mapstructure:"imagePullSecret,omitempty" cty:"imagePullSecret" hcl:"imagePullSecret"`
+	Path            *string `mapstructure:"path,omitempty" cty:"path" hcl:"path"`
+}
+
+// FlatMapstructure returns a new FlatContainerDiskVolume.
+// FlatContainerDiskVolume is an auto-generated flat version of ContainerDiskVolume.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*ContainerDiskVolume) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatContainerDiskVolume)
+}
+
+// HCL2Spec returns the hcl spec of a ContainerDiskVolume.
+// This spec is used by HCL to read the fields of ContainerDiskVolume.
+// The decoded values from this spec will then be applied to a FlatContainerDiskVolume.
+func (*FlatContainerDiskVolume) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"image":           &hcldec.AttrSpec{Name: "image", Type: cty.String, Required: false},
+		"imagePullSecret": &hcldec.AttrSpec{Name: "imagePullSecret", Type: cty.String, Required: false},
+		"path":            &hcldec.AttrSpec{Name: "path", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatDisk is an auto-generated flat version of Disk.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatDisk struct {
+	Name                  *string                          `mapstructure:"name" cty:"name" hcl:"name"`
+	Type                  *string                          `mapstructure:"type,omitempty" cty:"type" hcl:"type"`
+	Bus                   *string                          `mapstructure:"bus,omitempty" cty:"bus" hcl:"bus"`
+	BootOrder             *int                             `mapstructure:"bootOrder,omitempty" cty:"bootOrder" hcl:"bootOrder"`
+	Serial                *string                          `mapstructure:"serial,omitempty" cty:"serial" hcl:"serial"`
+	Output                *bool                            `mapstructure:"output,omitempty" cty:"output" hcl:"output"`
+	Blank                 *FlatBlankVolume                 `mapstructure:"blank" cty:"blank" hcl:"blank"`
+	PersistentVolumeClaim *FlatPersistentVolumeClaimVolume `mapstructure:"persistentVolumeClaim" cty:"persistentVolumeClaim" hcl:"persistentVolumeClaim"`
+	Secret                *FlatSecretVolume                `mapstructure:"secret" cty:"secret" hcl:"secret"`
+	ContainerDisk         *FlatContainerDiskVolume         `mapstructure:"containerDisk" cty:"containerDisk" hcl:"containerDisk"`
+}
+
+// FlatMapstructure returns a new FlatDisk.
+// FlatDisk is an auto-generated flat version of Disk.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Disk) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatDisk)
+}
+
+// HCL2Spec returns the hcl spec of a Disk.
+// This spec is used by HCL to read the fields of Disk.
+// The decoded values from this spec will then be applied to a FlatDisk.
+func (*FlatDisk) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"name":                  &hcldec.AttrSpec{Name: "name", Type: cty.String, Required: false},
+		"type":                  &hcldec.AttrSpec{Name: "type", Type: cty.String, Required: false},
+		"bus":                   &hcldec.AttrSpec{Name: "bus", Type: cty.String, Required: false},
+		"bootOrder":             &hcldec.AttrSpec{Name: "bootOrder", Type: cty.Number, Required: false},
+		"serial":                &hcldec.AttrSpec{Name: "serial", Type: cty.String, Required: false},
+		"output":                &hcldec.AttrSpec{Name: "output", Type: cty.Bool, Required: false},
+		"blank":                 &hcldec.BlockSpec{TypeName: "blank", Nested: hcldec.ObjectSpec((*FlatBlankVolume)(nil).HCL2Spec())},
+		"persistentVolumeClaim": &hcldec.BlockSpec{TypeName: "persistentVolumeClaim", Nested: hcldec.ObjectSpec((*FlatPersistentVolumeClaimVolume)(nil).HCL2Spec())},
+		"secret":                &hcldec.BlockSpec{TypeName: "secret", Nested: hcldec.ObjectSpec((*FlatSecretVolume)(nil).HCL2Spec())},
+		"containerDisk":         &hcldec.BlockSpec{TypeName: "containerDisk", Nested: hcldec.ObjectSpec((*FlatContainerDiskVolume)(nil).HCL2Spec())},
+	}
+	return s
+}
+
+// FlatIgnition is an auto-generated flat version of Ignition.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatIgnition struct {
+	Config *string `mapstructure:"config,omitempty" cty:"config" hcl:"config"`
+	File   *string `mapstructure:"file,omitempty" cty:"file" hcl:"file"`
+}
+
+// FlatMapstructure returns a new FlatIgnition.
+// FlatIgnition is an auto-generated flat version of Ignition.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Ignition) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatIgnition)
+}
+
+// HCL2Spec returns the hcl spec of a Ignition.
+// This spec is used by HCL to read the fields of Ignition.
+// The decoded values from this spec will then be applied to a FlatIgnition.
+func (*FlatIgnition) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"config": &hcldec.AttrSpec{Name: "config", Type: cty.String, Required: false},
+		"file":   &hcldec.AttrSpec{Name: "file", Type: cty.String, Required: false},
 	}
 	return s
 }
@@ -179,6 +441,70 @@ func (*FlatNetworkSource) HCL2Spec() map[string]hcldec.Spec {
 	return s
 }
 
+// FlatOSProfile is an auto-generated flat version of OSProfile.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatOSProfile struct {
+	CDRomBus         *string `mapstructure:"cdromBus,omitempty" cty:"cdromBus" hcl:"cdromBus"`
+	DiskBus          *string `mapstructure:"diskBus,omitempty" cty:"diskBus" hcl:"diskBus"`
+	Media            *string `mapstructure:"media,omitempty" cty:"media" hcl:"media"`
+	MediaVolumeLabel *string `mapstructure:"mediaVolumeLabel,omitempty" cty:"mediaVolumeLabel" hcl:"mediaVolumeLabel"`
+	VirtioDrivers    *bool   `mapstructure:"virtioDrivers,omitempty" cty:"virtioDrivers" hcl:"virtioDrivers"`
+	Communicator     *string `mapstructure:"communicator,omitempty" cty:"communicator" hcl:"communicator"`
+	ShutdownCommand  *string `mapstructure:"shutdownCommand,omitempty" cty:"shutdownCommand" hcl:"shutdownCommand"`
+	SealCommand      *string `mapstructure:"sealCommand,omitempty" cty:"sealCommand" hcl:"sealCommand"`
+	TrimCommand      *string `mapstructure:"trimCommand,omitempty" cty:"trimCommand" hcl:"trimCommand"`
+}
+
+// FlatMapstructure returns a new FlatOSProfile.
+// FlatOSProfile is an auto-generated flat version of OSProfile.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*OSProfile) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatOSProfile)
+}
+
+// HCL2Spec returns the hcl spec of a OSProfile.
+// This spec is used by HCL to read the fields of OSProfile.
+// The decoded values from this spec will then be applied to a FlatOSProfile.
+func (*FlatOSProfile) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"cdromBus":         &hcldec.AttrSpec{Name: "cdromBus", Type: cty.String, Required: false},
+		"diskBus":          &hcldec.AttrSpec{Name: "diskBus", Type: cty.String, Required: false},
+		"media":            &hcldec.AttrSpec{Name: "media", Type: cty.String, Required: false},
+		"mediaVolumeLabel": &hcldec.AttrSpec{Name: "mediaVolumeLabel", Type: cty.String, Required: false},
+		"virtioDrivers":    &hcldec.AttrSpec{Name: "virtioDrivers", Type: cty.Bool, Required: false},
+		"communicator":     &hcldec.AttrSpec{Name: "communicator", Type: cty.String, Required: false},
+		"shutdownCommand":  &hcldec.AttrSpec{Name: "shutdownCommand", Type: cty.String, Required: false},
+		"sealCommand":      &hcldec.AttrSpec{Name: "sealCommand", Type: cty.String, Required: false},
+		"trimCommand":      &hcldec.AttrSpec{Name: "trimCommand", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatPersistentVolumeClaimVolume is an auto-generated flat version of PersistentVolumeClaimVolume.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatPersistentVolumeClaimVolume struct {
+	ClaimName *string `mapstructure:"claimName" cty:"claimName" hcl:"claimName"`
+	ReadOnly  *bool   `mapstructure:"readOnly,omitempty" cty:"readOnly" hcl:"readOnly"`
+}
+
+// FlatMapstructure returns a new FlatPersistentVolumeClaimVolume.
+// FlatPersistentVolumeClaimVolume is an auto-generated flat version of PersistentVolumeClaimVolume.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*PersistentVolumeClaimVolume) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatPersistentVolumeClaimVolume)
+}
+
+// HCL2Spec returns the hcl spec of a PersistentVolumeClaimVolume.
+// This spec is used by HCL to read the fields of PersistentVolumeClaimVolume.
+// The decoded values from this spec will then be applied to a FlatPersistentVolumeClaimVolume.
+func (*FlatPersistentVolumeClaimVolume) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"claimName": &hcldec.AttrSpec{Name: "claimName", Type: cty.String, Required: false},
+		"readOnly":  &hcldec.AttrSpec{Name: "readOnly", Type: cty.Bool, Required: false},
+	}
+	return s
+}
+
 // FlatPodNetwork is an auto-generated flat version of PodNetwork.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatPodNetwork struct {
@@ -203,3 +529,117 @@ func (*FlatPodNetwork) HCL2Spec() map[string]hcldec.Spec {
 	}
 	return s
 }
+
+// FlatSecretVolume is an auto-generated flat version of SecretVolume.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatSecretVolume struct {
+	SecretName  *string `mapstructure:"secretName" cty:"secretName" hcl:"secretName"`
+	VolumeLabel *string `mapstructure:"volumeLabel,omitempty" cty:"volumeLabel" hcl:"volumeLabel"`
+}
+
+// FlatMapstructure returns a new FlatSecretVolume.
+// FlatSecretVolume is an auto-generated flat version of SecretVolume.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*SecretVolume) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatSecretVolume)
+}
+
+// HCL2Spec returns the hcl spec of a SecretVolume.
+// This spec is used by HCL to read the fields of SecretVolume.
+// The decoded values from this spec will then be applied to a FlatSecretVolume.
+func (*FlatSecretVolume) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"secretName":  &hcldec.AttrSpec{Name: "secretName", Type: cty.String, Required: false},
+		"volumeLabel": &hcldec.AttrSpec{Name: "volumeLabel", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatToleration is an auto-generated flat version of Toleration.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatToleration struct {
+	Key               *string `mapstructure:"key" cty:"key" hcl:"key"`
+	Operator          *string `mapstructure:"operator,omitempty" cty:"operator" hcl:"operator"`
+	Value             *string `mapstructure:"value,omitempty" cty:"value" hcl:"value"`
+	Effect            *string `mapstructure:"effect,omitempty" cty:"effect" hcl:"effect"`
+	TolerationSeconds *int64  `mapstructure:"tolerationSeconds,omitempty" cty:"tolerationSeconds" hcl:"tolerationSeconds"`
+}
+
+// FlatMapstructure returns a new FlatToleration.
+// FlatToleration is an auto-generated flat version of Toleration.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Toleration) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatToleration)
+}
+
+// HCL2Spec returns the hcl spec of a Toleration.
+// This spec is used by HCL to read the fields of Toleration.
+// The decoded values from this spec will then be applied to a FlatToleration.
+func (*FlatToleration) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"key":               &hcldec.AttrSpec{Name: "key", Type: cty.String, Required: false},
+		"operator":          &hcldec.AttrSpec{Name: "operator", Type: cty.String, Required: false},
+		"value":             &hcldec.AttrSpec{Name: "value", Type: cty.String, Required: false},
+		"effect":            &hcldec.AttrSpec{Name: "effect", Type: cty.String, Required: false},
+		"tolerationSeconds": &hcldec.AttrSpec{Name: "tolerationSeconds", Type: cty.Number, Required: false},
+	}
+	return s
+}
+
+// FlatVirtualMachineTemplate is an auto-generated flat version of VirtualMachineTemplate.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatVirtualMachineTemplate struct {
+	Kind   *string `mapstructure:"kind,omitempty" cty:"kind" hcl:"kind"`
+	Name   *string `mapstructure:"name,omitempty" cty:"name" hcl:"name"`
+	Path   *string `mapstructure:"path,omitempty" cty:"path" hcl:"path"`
+	Create *bool   `mapstructure:"create,omitempty" cty:"create" hcl:"create"`
+}
+
+// FlatMapstructure returns a new FlatVirtualMachineTemplate.
+// FlatVirtualMachineTemplate is an auto-generated flat version of VirtualMachineTemplate.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*VirtualMachineTemplate) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatVirtualMachineTemplate)
+}
+
+// HCL2Spec returns the hcl spec of a VirtualMachineTemplate.
+// This spec is used by HCL to read the fields of VirtualMachineTemplate.
+// The decoded values from this spec will then be applied to a FlatVirtualMachineTemplate.
+func (*FlatVirtualMachineTemplate) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"kind":   &hcldec.AttrSpec{Name: "kind", Type: cty.String, Required: false},
+		"name":   &hcldec.AttrSpec{Name: "name", Type: cty.String, Required: false},
+		"path":   &hcldec.AttrSpec{Name: "path", Type: cty.String, Required: false},
+		"create": &hcldec.AttrSpec{Name: "create", Type: cty.Bool, Required: false},
+	}
+	return s
+}
+
+// FlatVolumeSource is an auto-generated flat version of VolumeSource.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatVolumeSource struct {
+	Blank                 *FlatBlankVolume                 `mapstructure:"blank" cty:"blank" hcl:"blank"`
+	PersistentVolumeClaim *FlatPersistentVolumeClaimVolume `mapstructure:"persistentVolumeClaim" cty:"persistentVolumeClaim" hcl:"persistentVolumeClaim"`
+	Secret                *FlatSecretVolume                `mapstructure:"secret" cty:"secret" hcl:"secret"`
+	ContainerDisk         *FlatContainerDiskVolume         `mapstructure:"containerDisk" cty:"containerDisk" hcl:"containerDisk"`
+}
+
+// FlatMapstructure returns a new FlatVolumeSource.
+// FlatVolumeSource is an auto-generated flat version of VolumeSource.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*VolumeSource) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatVolumeSource)
+}
+
+// HCL2Spec returns the hcl spec of a VolumeSource.
+// This spec is used by HCL to read the fields of VolumeSource.
+// The decoded values from this spec will then be applied to a FlatVolumeSource.
+func (*FlatVolumeSource) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"blank":                 &hcldec.BlockSpec{TypeName: "blank", Nested: hcldec.ObjectSpec((*FlatBlankVolume)(nil).HCL2Spec())},
+		"persistentVolumeClaim": &hcldec.BlockSpec{TypeName: "persistentVolumeClaim", Nested: hcldec.ObjectSpec((*FlatPersistentVolumeClaimVolume)(nil).HCL2Spec())},
+		"secret":                &hcldec.BlockSpec{TypeName: "secret", Nested: hcldec.ObjectSpec((*FlatSecretVolume)(nil).HCL2Spec())},
+		"containerDisk":         &hcldec.BlockSpec{TypeName: "containerDisk", Nested: hcldec.ObjectSpec((*FlatContainerDiskVolume)(nil).HCL2Spec())},
+	}
+	return s
+}
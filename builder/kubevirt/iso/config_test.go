@@ -0,0 +1,371 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+var _ = Describe("Config", func() {
+	var raw map[string]interface{}
+
+	// prepare returns the prepared config, and the errors reported by Prepare.
+	prepare := func() (iso.Config, []error) {
+		var c iso.Config
+		_, err := c.Prepare(raw)
+		if err == nil {
+			return c, nil
+		}
+		multiErr, ok := err.(*packer.MultiError)
+		Expect(ok).To(BeTrue(), "expected a MultiError, got %v", err)
+		return c, multiErr.Errors
+	}
+
+	// messages returns the messages of the errors.
+	messages := func(errs []error) []string {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return msgs
+	}
+
+	BeforeEach(func() {
+		raw = map[string]interface{}{
+			"kube_config":     "kubeconfig",
+			"name":            "fedora",
+			"namespace":       "default",
+			"iso_volume_name": "fedora-iso",
+			"disk_size":       "64Gi",
+			"memory":          "4Gi",
+		}
+	})
+
+	Context("Prepare", func() {
+		It("applies the documented defaults", func() {
+			raw["communicator"] = "ssh"
+			raw["ssh_local_port"] = 2020
+			raw["disks"] = []map[string]interface{}{
+				{"name": "data", "blank": map[string]interface{}{"size": "10Gi"}},
+			}
+			raw["tolerations"] = []map[string]interface{}{
+				{"key": "dedicated", "value": "packer"},
+			}
+			raw["cloud_init"] = map[string]interface{}{"user_data": "#cloud-config"}
+			raw["vm_template"] = map[string]interface{}{"path": "vm.yaml"}
+
+			c, errs := prepare()
+			Expect(errs).To(BeEmpty())
+			Expect(c.OperatingSystemType).To(Equal("linux"))
+			Expect(c.InstanceTypeKind).To(Equal("virtualmachineclusterinstancetype"))
+			Expect(c.PreferenceKind).To(Equal("virtualmachineclusterpreference"))
+			Expect(c.SealTimeout).To(Equal(30 * time.Minute))
+			Expect(c.ShutdownTimeout).To(Equal(5 * time.Minute))
+			Expect(c.BuildLeaseTTL).To(Equal(24 * time.Hour))
+			Expect(c.SSHRemotePort).To(Equal(22))
+			Expect(c.WinRMRemotePort).To(Equal(5985))
+			Expect(c.CustomizeImage).To(Equal("quay.io/kubevirt/libguestfs-tools:v1.5.2"))
+			Expect(c.VirtioContainerImage).To(Equal("quay.io/kubevirt/virtio-container-disk:v1.5.2"))
+			Expect(c.Disks[0].Type).To(Equal("disk"))
+			Expect(c.Tolerations[0].Operator).To(Equal("Equal"))
+			Expect(c.CloudInit.Type).To(Equal("NoCloud"))
+			Expect(c.VirtualMachineTemplate.Kind).To(Equal("VirtualMachine"))
+			Expect(c.VirtualMachineTemplate.Name).To(Equal("fedora"))
+		})
+
+		It("defaults networks without a type to the pod network", func() {
+			raw["networks"] = []map[string]interface{}{{"name": "default"}}
+
+			c, errs := prepare()
+			Expect(errs).To(BeEmpty())
+			Expect(c.Networks[0].Pod).NotTo(BeNil())
+		})
+
+		It("filters the communicator passwords from the logs", func() {
+			raw["communicator"] = "ssh"
+			raw["ssh_local_port"] = 2020
+			raw["ssh_username"] = "user"
+			raw["ssh_password"] = "ssh-secret"
+
+			_, errs := prepare()
+			Expect(errs).To(BeEmpty())
+			Expect(packer.LogSecretFilter.FilterString("password ssh-secret")).To(Equal("password <sensitive>"))
+		})
+
+		It("rejects an SSH private key file that cannot be parsed", func() {
+			keyFile := filepath.Join(GinkgoT().TempDir(), "id_rsa")
+			Expect(os.WriteFile(keyFile, []byte("not a key"), 0600)).To(Succeed())
+			raw["ssh_private_key_file"] = keyFile
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(HavePrefix("ssh_private_key_file: ")))
+		})
+
+		It("reports all the errors at once", func() {
+			raw["name"] = "Fedora_40"
+			raw["disk_size"] = "64GB"
+			raw["os_type"] = "plan9"
+			raw["communicator"] = "ssh"
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				ContainSubstring(`name "Fedora_40" is not valid`),
+				ContainSubstring(`disk_size: "64GB" is not a valid quantity`),
+				ContainSubstring(`OS type of 'plan9' is not supported`),
+				ContainSubstring("ssh_local_port must be set with the ssh communicator"),
+			))
+		})
+
+		It("rejects names too long for the names of the temporary resources", func() {
+			// The longest suffix is "-outputdisk", after the build ID: 63 - 6 - 11 characters.
+			raw["name"] = strings.Repeat("a", 46)
+
+			_, errs := prepare()
+			Expect(errs).To(BeEmpty())
+
+			raw["name"] = strings.Repeat("a", 47)
+
+			_, errs = prepare()
+			Expect(messages(errs)).To(ConsistOf(ContainSubstring("it must be no more than 46 characters")))
+
+			// The names of the volumes of the disks are derived from the name as well.
+			raw["name"] = strings.Repeat("a", 43)
+			raw["disks"] = []map[string]interface{}{
+				{"name": "scratchpad", "blank": map[string]interface{}{"size": "1Gi"}},
+			}
+
+			_, errs = prepare()
+			Expect(messages(errs)).To(ConsistOf(ContainSubstring("it must be no more than 42 characters")))
+		})
+
+		It("requires the name, namespace, ISO volume and disk size", func() {
+			raw = map[string]interface{}{"memory": "4Gi"}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				"name must be set",
+				"namespace must be set",
+				"iso_volume_name must be set",
+				"disk_size: must be set",
+			))
+		})
+
+		It("rejects quantities that are not positive", func() {
+			raw["memory"] = "0"
+			raw["disks"] = []map[string]interface{}{
+				{"name": "data", "blank": map[string]interface{}{"size": "-1Gi"}},
+			}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				`memory: "0" must be greater than zero`,
+				`disk "data": blank size: "-1Gi" must be greater than zero`,
+			))
+		})
+
+		It("accepts an output disk size smaller than the disk size, or minimal", func() {
+			for _, size := range []string{"32Gi", "minimal", "128Gi"} {
+				raw["output_disk_size"] = size
+
+				_, errs := prepare()
+				Expect(errs).To(BeEmpty())
+			}
+		})
+
+		It("rejects an output disk size that is not a quantity", func() {
+			raw["output_disk_size"] = "smallest"
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(ContainSubstring(`output_disk_size: "smallest" is not a valid quantity`)))
+		})
+
+		It("rejects fstrim without a trim command or a communicator", func() {
+			raw["fstrim"] = true
+			raw["os_type"] = "freebsd"
+			raw["communicator"] = "none"
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				"fstrim is not supported by the OS profile, which has no trim command",
+				"fstrim requires the ssh or winrm communicator",
+			))
+		})
+
+		It("rejects media content outside of the root of the media", func() {
+			raw["media_content"] = map[string]interface{}{
+				"ks.cfg":           "",
+				"scripts/setup.sh": "",
+				"/etc/passwd":      "",
+				"../ks.cfg":        "",
+				"scripts/../../x":  "",
+			}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				`media_content: path "../ks.cfg" must not contain ".."`,
+				`media_content: path "/etc/passwd" must be relative to the root of the media`,
+				`media_content: path "scripts/../../x" must not contain ".."`,
+			))
+		})
+
+		It("rejects media files with an OS profile without media", func() {
+			raw["os_type"] = "coreos"
+			raw["media_content"] = map[string]interface{}{"config.ign": "{}"}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf("media_files, media_content and media_templates are not supported by an OS profile without media"))
+		})
+
+		It("rejects cloud-init meta data that KubeVirt cannot set", func() {
+			raw["cloud_init"] = map[string]interface{}{
+				"user_data": "#cloud-config",
+				"meta_data": map[string]interface{}{
+					"local_hostname":         "Fedora_Build",
+					"public_keys_secret_ref": "build-keys",
+				},
+			}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				ContainSubstring(`cloud_init: local_hostname "Fedora_Build" is not valid`),
+				"cloud_init: public_keys_secret_ref is only supported by the ConfigDrive data source",
+			))
+		})
+
+		It("rejects a NoCloud data source along with a cidata media CD-ROM", func() {
+			raw["os_type"] = "ubuntu-autoinstall"
+			raw["cloud_init"] = map[string]interface{}{"user_data": "#cloud-config"}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(`cloud_init: the NoCloud data source cannot be used along with the media CD-ROM labelled "cidata", use ConfigDrive instead`))
+
+			raw["cloud_init"] = map[string]interface{}{"type": "ConfigDrive", "user_data": "#cloud-config"}
+
+			_, errs = prepare()
+			Expect(errs).To(BeEmpty())
+		})
+
+		It("rejects invalid namespaces and disk names", func() {
+			raw["build_namespace"] = "Packer.Builds"
+			raw["disks"] = []map[string]interface{}{
+				{"name": "Data", "blank": map[string]interface{}{"size": "1Gi"}},
+			}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				ContainSubstring(`build_namespace "Packer.Builds" is not valid`),
+				ContainSubstring(`disk "Data": name is not valid`),
+			))
+		})
+
+		It("rejects reserved and duplicate boot orders", func() {
+			raw["disks"] = []map[string]interface{}{
+				{"name": "data", "bootOrder": 4, "blank": map[string]interface{}{"size": "1Gi"}},
+				{"name": "logs", "bootOrder": 4, "blank": map[string]interface{}{"size": "1Gi"}},
+				{"name": "tools", "bootOrder": 2, "containerDisk": map[string]interface{}{"image": "tools:latest"}},
+				{"name": "scratch", "bootOrder": -1, "blank": map[string]interface{}{"size": "1Gi"}},
+			}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				`disk "logs": boot order 4 is already used by disk "data"`,
+				`disk "tools": boot order 2 is reserved, set a boot order greater than 3`,
+				`disk "scratch": boot order -1 must be greater than zero`,
+			))
+		})
+
+		It("rejects ports out of range", func() {
+			raw["communicator"] = "winrm"
+			raw["winrm_local_port"] = 70000
+			raw["ssh_remote_port"] = -1
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				ContainSubstring("winrm_local_port 70000 is not valid"),
+				ContainSubstring("ssh_remote_port -1 is not valid"),
+			))
+		})
+
+		It("rejects unsupported kinds", func() {
+			raw["instance_type"] = "u1.medium"
+			raw["instance_type_kind"] = "instancetype"
+			raw["preference_kind"] = "preference"
+			raw["communicator"] = "telnet"
+			delete(raw, "memory")
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				ContainSubstring(`instance_type_kind "instancetype" is not supported`),
+				ContainSubstring(`preference_kind "preference" is not supported`),
+				ContainSubstring(`communicator "telnet" is not supported`),
+			))
+		})
+
+		It("rejects tolerations with an unsupported operator or effect", func() {
+			raw["tolerations"] = []map[string]interface{}{
+				{"key": "dedicated", "operator": "In"},
+				{"operator": "Exists", "effect": "NoWay"},
+				{"value": "packer"},
+			}
+
+			_, errs := prepare()
+			Expect(messages(errs)).To(ConsistOf(
+				ContainSubstring(`toleration 0: operator "In" is not supported`),
+				ContainSubstring(`toleration 1: effect "NoWay" is not supported`),
+				ContainSubstring(`toleration 2: operator must be "Exists" if the key is empty`),
+			))
+		})
+
+		Context("networks", func() {
+			It("rejects duplicate network names", func() {
+				raw["networks"] = []map[string]interface{}{
+					{"name": "default", "pod": map[string]interface{}{}},
+					{"name": "default", "multus": map[string]interface{}{"networkName": "vlan10"}},
+				}
+
+				_, errs := prepare()
+				Expect(messages(errs)).To(ConsistOf(`network "default": name is already in use`))
+			})
+
+			It("requires exactly one default network", func() {
+				raw["networks"] = []map[string]interface{}{
+					{"name": "vlan10", "multus": map[string]interface{}{"networkName": "vlan10"}},
+					{"name": "vlan20", "multus": map[string]interface{}{"networkName": "vlan20"}},
+				}
+
+				_, errs := prepare()
+				Expect(messages(errs)).To(ConsistOf(ContainSubstring("exactly one network must be the default network")))
+			})
+
+			It("rejects a default multus network along with the pod network", func() {
+				raw["networks"] = []map[string]interface{}{
+					{"name": "default", "pod": map[string]interface{}{}},
+					{"name": "vlan10", "multus": map[string]interface{}{"networkName": "vlan10", "default": true}},
+				}
+
+				_, errs := prepare()
+				Expect(messages(errs)).To(ConsistOf(ContainSubstring("found 2")))
+			})
+
+			It("accepts a default multus network", func() {
+				raw["networks"] = []map[string]interface{}{
+					{"name": "vlan10", "multus": map[string]interface{}{"networkName": "vlan10", "default": true}},
+					{"name": "vlan20", "multus": map[string]interface{}{"networkName": "vlan20"}},
+				}
+
+				_, errs := prepare()
+				Expect(errs).To(BeEmpty())
+			})
+		})
+	})
+})
@@ -0,0 +1,18 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+// WithBuildID returns a copy of the config whose temporary resources are suffixed with id,
+// as done by Builder.Run.
+func (c Config) WithBuildID(id string) Config {
+	c.buildID = id
+	return c
+}
+
+// WithSSHPrivateKeyFile returns a copy of the config connecting via SSH with the private key
+// of the file, as done by Prepare.
+func (c Config) WithSSHPrivateKeyFile(path string) (Config, error) {
+	c.SSHPrivateKeyFile = path
+	return c, c.readSSHKeyPair()
+}
@@ -4,52 +4,349 @@
 package iso
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	templatev1 "github.com/openshift/api/template/v1"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	ptr "k8s.io/utils/ptr"
 
 	v1 "kubevirt.io/api/core/v1"
 	instancetypeapi "kubevirt.io/api/instancetype"
 	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+
+	"sigs.k8s.io/yaml"
 )
 
-func configMap(name string, mediaFiles []string) (*corev1.ConfigMap, error) {
+// reservedDiskNames are the disk names used by the VM layouts,
+// which cannot be used by additional disks.
+var reservedDiskNames = map[string]bool{
+	"root":                true,
+	"iso":                 true,
+	"rootdisk":            true,
+	"media":               true,
+	"cdrom":               true,
+	"oemdrv":              true,
+	"sysprep":             true,
+	"virtiocontainerdisk": true,
+	"cloudinit":           true,
+}
+
+// maxReservedBootOrder is the highest boot order used by the VM layouts, which boot the root disk,
+// the installation ISO and the media CD-ROM in orders 1, 2 and 3.
+const maxReservedBootOrder = 3
+
+// defaultCustomizeImage is the container image providing the libguestfs tools.
+const defaultCustomizeImage = "quay.io/kubevirt/libguestfs-tools:v1.5.2"
+
+// defaultVirtioContainerImage is the container image providing the VirtIO drivers to Windows VMs.
+const defaultVirtioContainerImage = "quay.io/kubevirt/virtio-container-disk:v1.5.2"
+
+// buildLeaseLabel labels the build leases, and buildLeaseTTLAnnotation holds
+// the time after which a build lease is considered stale.
+const (
+	buildLeaseLabel         = "packer.io/build-lease"
+	buildLeaseTTLAnnotation = "packer.io/build-lease-ttl"
+)
+
+// maxConfigMapSize is the maximum size of the data stored in a ConfigMap or a Secret.
+const maxConfigMapSize = 1024 * 1024
+
+func configMap(name string, files map[string][]byte) *corev1.ConfigMap {
 	data := make(map[string]string)
+	binaryData := make(map[string][]byte)
 
-	for _, path := range mediaFiles {
-		content, err := os.ReadFile(path)
-		if err != nil {
-			return nil, err
+	for filename, content := range files {
+		if utf8.Valid(content) {
+			data[filename] = string(content)
+		} else {
+			binaryData[filename] = content
 		}
+	}
 
-		filename := filepath.Base(path)
-		data[filename] = string(content)
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Data:       data,
+		BinaryData: binaryData,
 	}
+}
 
+// buildLease returns the ConfigMap owning the temporary resources of a build.
+func buildLease(name string, ttl time.Duration) *corev1.ConfigMap {
 	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: name,
+			Labels: map[string]string{
+				buildLeaseLabel: "true",
+			},
+			Annotations: map[string]string{
+				buildLeaseTTLAnnotation: ttl.String(),
+			},
+		},
+	}
+}
+
+// ownerReferences returns the owner references of the resources owned by the build lease.
+func ownerReferences(lease *corev1.ConfigMap) []metav1.OwnerReference {
+	if lease == nil {
+		return nil
+	}
+
+	return []metav1.OwnerReference{
+		{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Name:       lease.Name,
+			UID:        lease.UID,
+		},
+	}
+}
+
+func secret(name string, files map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: files,
+	}
+}
+
+// blankVolume returns a DataVolume of an empty disk of the given size.
+func blankVolume(name, size string) (*cdiv1.DataVolume, error) {
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid disk size %q: %w", size, err)
+	}
+
+	return &cdiv1.DataVolume{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: cdiv1.CDIGroupVersionKind.GroupVersion().String(),
+			Kind:       "DataVolume",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: cdiv1.DataVolumeSpec{
+			Source: &cdiv1.DataVolumeSource{
+				Blank: &cdiv1.DataVolumeBlankImage{},
+			},
+			Storage: &cdiv1.StorageSpec{
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceName(corev1.ResourceStorage): quantity,
+					},
+				},
+			},
 		},
-		Data: data,
 	}, nil
 }
 
-func virtualMachine(
-	name,
-	isoVolumeName,
-	diskSize,
-	instanceType,
-	preferenceName,
-	instanceTypeKind,
-	preferenceKind,
-	osType string,
-	networks []Network) *v1.VirtualMachine {
-	var disks []v1.Disk
-	var volumes []v1.Volume
+func uploadVolume(name string, size int64) *cdiv1.DataVolume {
+	// The Storage API adds the filesystem overhead of CDI to the requested size. The headroom,
+	// 10% of the image but at least 1MiB, covers the provisioners rounding the size down to their
+	// block size, or ignoring the overhead of the image file. Round up to the next MiB.
+	const mebibyte = 1024 * 1024
+	size += max(size/10, mebibyte)
+	size = (size + mebibyte - 1) / mebibyte * mebibyte
+
+	return &cdiv1.DataVolume{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: cdiv1.CDIGroupVersionKind.GroupVersion().String(),
+			Kind:       "DataVolume",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: cdiv1.DataVolumeSpec{
+			Source: &cdiv1.DataVolumeSource{
+				Upload: &cdiv1.DataVolumeSourceUpload{},
+			},
+			Storage: &cdiv1.StorageSpec{
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceName(corev1.ResourceStorage): *resource.NewQuantity(size, resource.BinarySI),
+					},
+				},
+			},
+		},
+	}
+}
+
+// readMediaFiles reads the media files, keyed by their path relative to the root of the media.
+// Files are placed at the root, directories keep their name and structure, and glob patterns
+// are expanded. Two media files with the same path result in an error.
+func readMediaFiles(mediaFiles []string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	sources := make(map[string]string)
+
+	add := func(relPath, path string) error {
+		relPath = filepath.ToSlash(relPath)
+		if source, ok := sources[relPath]; ok {
+			return fmt.Errorf("media files %q and %q have the same path %q", source, path, relPath)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[relPath] = content
+		sources[relPath] = path
+		return nil
+	}
+
+	for _, pattern := range mediaFiles {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			paths = []string{pattern}
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+
+			if !info.IsDir() {
+				if err := add(filepath.Base(path), path); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			parent := filepath.Dir(filepath.Clean(path))
+			err = filepath.WalkDir(path, func(filePath string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+
+				relPath, err := filepath.Rel(parent, filePath)
+				if err != nil {
+					return err
+				}
+				return add(relPath, filePath)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// mediaTemplateData is the data available to the media templates.
+type mediaTemplateData struct {
+	Name          string
+	Namespace     string
+	SSHUsername   string
+	SSHPassword   string
+	SSHPublicKey  string
+	WinRMUsername string
+	WinRMPassword string
+}
+
+// readMedia reads the media files and templates, and merges them with the inline media content.
+// Templates and inline content are rendered with the build variables.
+func readMedia(config Config) (map[string][]byte, error) {
+	files, err := readMediaFiles(config.MediaFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := readMediaFiles(config.MediaTemplates)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make(map[string]string, len(templates)+len(config.MediaContent))
+	for relPath, data := range templates {
+		content[relPath] = string(data)
+	}
+	for relPath, data := range config.MediaContent {
+		if _, ok := content[relPath]; ok {
+			return nil, fmt.Errorf("media content %q conflicts with a media template", relPath)
+		}
+		content[relPath] = data
+	}
+
+	ctx := config.ctx
+	ctx.Data = &mediaTemplateData{
+		Name:          config.Name,
+		Namespace:     config.buildNamespace(),
+		SSHUsername:   config.SSHUsername,
+		SSHPassword:   config.SSHPassword,
+		SSHPublicKey:  config.sshPublicKey(),
+		WinRMUsername: config.WinRMUsername,
+		WinRMPassword: config.WinRMPassword,
+	}
+
+	for relPath, data := range content {
+		relPath = path.Clean(filepath.ToSlash(relPath))
+		if _, ok := files[relPath]; ok {
+			return nil, fmt.Errorf("media content %q conflicts with a media file", relPath)
+		}
+
+		rendered, err := interpolate.Render(data, &ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering media content %q: %w", relPath, err)
+		}
+		files[relPath] = []byte(rendered)
+	}
+	return files, nil
+}
+
+// hasNestedMediaFiles returns whether any media file is located in a directory,
+// which cannot be represented by the keys of a ConfigMap or a Secret.
+func hasNestedMediaFiles(files map[string][]byte) bool {
+	for relPath := range files {
+		if strings.Contains(relPath, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadMedia returns whether the media files are uploaded as an ISO image into a DataVolume,
+// rather than stored in a ConfigMap or a Secret.
+func uploadMedia(config Config, files map[string][]byte) bool {
+	return config.MediaFilesISO || mediaFilesSize(files) > maxConfigMapSize || hasNestedMediaFiles(files)
+}
+
+func mediaFilesSize(files map[string][]byte) int {
+	size := 0
+	for filename, content := range files {
+		size += len(filename) + len(content)
+	}
+	return size
+}
+
+// virtualMachine returns the temporary VM. If mediaVolumeName is set, the media files
+// are attached from that DataVolume instead of the ConfigMap or Secret.
+func virtualMachine(config Config, mediaVolumeName string) (*v1.VirtualMachine, error) {
+	name := config.buildName()
+	diskSize := config.DiskSize
+	instanceType := config.InstanceType
+	preferenceName := config.Preference
+	instanceTypeKind := config.InstanceTypeKind
+	preferenceKind := config.PreferenceKind
+	networks := config.Networks
 
 	vmNetworks := make([]v1.Network, len(networks))
 	vmInterfaces := make([]v1.Interface, len(networks))
@@ -62,20 +359,107 @@ func virtualMachine(
 		preferenceKind = instancetypeapi.ClusterSingularPreferenceResourceName
 	}
 
-	if osType == "linux" {
-		disks = getLinuxVirtualMachineDisks()
-		volumes = getLinuxVirtualMachineVolumes(name, isoVolumeName)
+	profile, err := config.osProfile()
+	if err != nil {
+		return nil, err
 	}
+	disks, volumes := osProfileLayout(config, profile, mediaVolumeName)
 
-	if osType == "windows" {
-		disks = getWindowsVirtualMachineDisks()
-		volumes = getWindowsVirtualMachineVolumes(name, isoVolumeName)
+	var annotations map[string]string
+	if config.Ignition != nil {
+		annotations = map[string]string{
+			v1.IgnitionAnnotation: config.Ignition.Config,
+		}
+	}
+
+	var hostname string
+	var accessCredentials []v1.AccessCredential
+	if config.CloudInit != nil {
+		disk, volume := convertToCloudInit(*config.CloudInit)
+		disks = append(disks, disk)
+		volumes = append(volumes, volume)
+		hostname, accessCredentials = convertToCloudInitMetaData(config.CloudInit.MetaData)
 	}
 
 	for i, n := range networks {
 		vmNetworks[i], vmInterfaces[i] = convertToNetwork(n)
 	}
 
+	size, err := resource.ParseQuantity(diskSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid disk size %q: %w", diskSize, err)
+	}
+
+	dataVolumeTemplates := []v1.DataVolumeTemplateSpec{
+		dataVolumeTemplate(diskVolumeName(name, "root"), size),
+	}
+
+	if config.isoNamespace() != config.buildNamespace() {
+		dataVolumeTemplates = append(dataVolumeTemplates, isoCloneTemplate(config))
+	}
+
+	for _, d := range config.Disks {
+		disk, volume, err := convertToDisk(name, d)
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, disk)
+		volumes = append(volumes, volume)
+
+		if d.Blank != nil {
+			size, err := resource.ParseQuantity(d.Blank.Size)
+			if err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.Name, err)
+			}
+			dataVolumeTemplates = append(dataVolumeTemplates, dataVolumeTemplate(volume.DataVolume.Name, size))
+		}
+	}
+
+	vmAffinity, err := affinity(config.Affinity)
+	if err != nil {
+		return nil, err
+	}
+
+	var instancetypeMatcher *v1.InstancetypeMatcher
+	if instanceType != "" {
+		instancetypeMatcher = &v1.InstancetypeMatcher{
+			Kind: instanceTypeKind,
+			Name: instanceType,
+		}
+	}
+
+	var preferenceMatcher *v1.PreferenceMatcher
+	if preferenceName != "" {
+		preferenceMatcher = &v1.PreferenceMatcher{
+			Kind: preferenceKind,
+			Name: preferenceName,
+		}
+	}
+
+	var cpu *v1.CPU
+	if config.CPU > 0 {
+		cpu = &v1.CPU{Cores: uint32(config.CPU)}
+	}
+
+	var memory *v1.Memory
+	if config.Memory != "" {
+		guest, err := resource.ParseQuantity(config.Memory)
+		if err != nil {
+			return nil, err
+		}
+		memory = &v1.Memory{Guest: &guest}
+	}
+
+	var machine *v1.Machine
+	if config.MachineType != "" {
+		machine = &v1.Machine{Type: config.MachineType}
+	}
+
+	var evictionStrategy *v1.EvictionStrategy
+	if config.EvictionStrategy != "" {
+		evictionStrategy = ptr.To(v1.EvictionStrategy(config.EvictionStrategy))
+	}
+
 	return &v1.VirtualMachine{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: v1.GroupVersion.String(),
@@ -85,39 +469,27 @@ func virtualMachine(
 			Name: name,
 		},
 		Spec: v1.VirtualMachineSpec{
-			RunStrategy: ptr.To(v1.RunStrategyAlways),
-			Instancetype: &v1.InstancetypeMatcher{
-				Kind: instanceTypeKind,
-				Name: instanceType,
-			},
-			Preference: &v1.PreferenceMatcher{
-				Kind: preferenceKind,
-				Name: preferenceName,
-			},
-			DataVolumeTemplates: []v1.DataVolumeTemplateSpec{
-				{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: name + "-rootdisk",
-					},
-					Spec: cdiv1.DataVolumeSpec{
-						PVC: &corev1.PersistentVolumeClaimSpec{
-							Resources: corev1.VolumeResourceRequirements{
-								Requests: corev1.ResourceList{
-									corev1.ResourceName(corev1.ResourceStorage): resource.MustParse(diskSize),
-								},
-							},
-							AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
-						},
-						Source: &cdiv1.DataVolumeSource{
-							Blank: &cdiv1.DataVolumeBlankImage{},
-						},
-					},
-				},
-			},
+			RunStrategy:         ptr.To(v1.RunStrategyAlways),
+			Instancetype:        instancetypeMatcher,
+			Preference:          preferenceMatcher,
+			DataVolumeTemplates: dataVolumeTemplates,
 			Template: &v1.VirtualMachineInstanceTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: annotations,
+				},
 				Spec: v1.VirtualMachineInstanceSpec{
-					Networks: vmNetworks,
+					NodeSelector:      config.NodeSelector,
+					Tolerations:       convertToTolerations(config.Tolerations),
+					Affinity:          vmAffinity,
+					PriorityClassName: config.PriorityClassName,
+					EvictionStrategy:  evictionStrategy,
+					Hostname:          hostname,
+					AccessCredentials: accessCredentials,
+					Networks:          vmNetworks,
 					Domain: v1.DomainSpec{
+						CPU:     cpu,
+						Memory:  memory,
+						Machine: machine,
 						Devices: v1.Devices{
 							Interfaces: vmInterfaces,
 							Disks:      disks,
@@ -127,11 +499,67 @@ func virtualMachine(
 				},
 			},
 		},
+	}, nil
+}
+
+func dataVolumeTemplate(name string, size resource.Quantity) v1.DataVolumeTemplateSpec {
+	return v1.DataVolumeTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: cdiv1.DataVolumeSpec{
+			PVC: &corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceName(corev1.ResourceStorage): size,
+					},
+				},
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			},
+			Source: &cdiv1.DataVolumeSource{
+				Blank: &cdiv1.DataVolumeBlankImage{},
+			},
+		},
 	}
 }
 
-func cloneVolume(name, namespace, diskSize string) *cdiv1.DataVolume {
-	return &cdiv1.DataVolume{
+// isoCloneTemplate returns a DataVolume template cloning the ISO DataVolume
+// from the ISO namespace into the namespace of the temporary VM.
+func isoCloneTemplate(config Config) v1.DataVolumeTemplateSpec {
+	return v1.DataVolumeTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: isoVolumeName(config),
+		},
+		Spec: cdiv1.DataVolumeSpec{
+			Source: &cdiv1.DataVolumeSource{
+				PVC: &cdiv1.DataVolumeSourcePVC{
+					Name:      config.IsoVolumeName,
+					Namespace: config.isoNamespace(),
+				},
+			},
+			Storage: &cdiv1.StorageSpec{},
+		},
+	}
+}
+
+// isoVolumeName returns the name of the DataVolume attached as the installation ISO,
+// which is a clone when the ISO DataVolume is in another namespace.
+func isoVolumeName(config Config) string {
+	if config.isoNamespace() != config.buildNamespace() {
+		return diskVolumeName(config.buildName(), "iso")
+	}
+	return config.IsoVolumeName
+}
+
+// diskVolumeName returns the name of the DataVolume backing a disk of the temporary VM,
+// e.g. `<name>-rootdisk` for the root disk.
+func diskVolumeName(name, diskName string) string {
+	return name + "-" + diskName + "disk"
+}
+
+// cloneVolume returns a DataVolume cloning a disk of the temporary VM from the given namespace.
+func cloneVolume(name, sourceNamespace, sourceName, diskSize string) (*cdiv1.DataVolume, error) {
+	dv := &cdiv1.DataVolume{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: cdiv1.CDIGroupVersionKind.GroupVersion().String(),
 			Kind:       "DataVolume",
@@ -142,34 +570,52 @@ func cloneVolume(name, namespace, diskSize string) *cdiv1.DataVolume {
 		Spec: cdiv1.DataVolumeSpec{
 			Source: &cdiv1.DataVolumeSource{
 				PVC: &cdiv1.DataVolumeSourcePVC{
-					Name:      name + "-rootdisk",
-					Namespace: namespace,
+					Name:      sourceName,
+					Namespace: sourceNamespace,
 				},
 			},
-			PVC: &corev1.PersistentVolumeClaimSpec{
-				Resources: corev1.VolumeResourceRequirements{
-					Requests: corev1.ResourceList{
-						corev1.ResourceName(corev1.ResourceStorage): resource.MustParse(diskSize),
-					},
-				},
-				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		},
+	}
+
+	// Without a size, the size of the source volume is used.
+	if diskSize == "" {
+		dv.Spec.Storage = &cdiv1.StorageSpec{}
+		return dv, nil
+	}
+
+	size, err := resource.ParseQuantity(diskSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid disk size %q: %w", diskSize, err)
+	}
+
+	dv.Spec.PVC = &corev1.PersistentVolumeClaimSpec{
+		Resources: corev1.VolumeResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceName(corev1.ResourceStorage): size,
 			},
 		},
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
 	}
+	return dv, nil
 }
 
 func sourceVolume(name, namespace, instanceType, preferenceName string) *cdiv1.DataSource {
+	labels := map[string]string{}
+	if instanceType != "" {
+		labels[instancetypeapi.DefaultInstancetypeLabel] = instanceType
+	}
+	if preferenceName != "" {
+		labels[instancetypeapi.DefaultPreferenceLabel] = preferenceName
+	}
+
 	return &cdiv1.DataSource{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: cdiv1.CDIGroupVersionKind.GroupVersion().String(),
 			Kind:       "DataSource",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
-			Labels: map[string]string{
-				"instancetype.kubevirt.io/default-instancetype": instanceType,
-				"instancetype.kubevirt.io/default-preference":   preferenceName,
-			},
+			Name:   name,
+			Labels: labels,
 		},
 		Spec: cdiv1.DataSourceSpec{
 			Source: cdiv1.DataSourceSource{
@@ -182,30 +628,35 @@ func sourceVolume(name, namespace, instanceType, preferenceName string) *cdiv1.D
 	}
 }
 
-func getLinuxVirtualMachineDisks() []v1.Disk {
-	rootdisk := uint(1)
-	cdrom := uint(2)
-	oemdrv := uint(3)
+// templateVirtualMachine returns a halted VirtualMachine booting from the published image,
+// with a clone of each exported disk.
+func templateVirtualMachine(config Config, name string) (*v1.VirtualMachine, error) {
+	namespace := config.outputNamespace()
+	instanceType, preferenceName := config.outputDefaults()
 
-	return []v1.Disk{
-		{
-			Name: "cdrom",
-			DiskDevice: v1.DiskDevice{
-				CDRom: &v1.CDRomTarget{
-					Tray: "closed",
-				},
-			},
-			BootOrder: &cdrom,
-		},
-		{
-			Name: "oemdrv",
-			DiskDevice: v1.DiskDevice{
-				CDRom: &v1.CDRomTarget{
-					Tray: "closed",
-				},
-			},
-			BootOrder: &oemdrv,
-		},
+	vmConfig := Config{
+		Name:             name,
+		DiskSize:         config.DiskSize,
+		InstanceType:     instanceType,
+		InstanceTypeKind: config.InstanceTypeKind,
+		Preference:       preferenceName,
+		PreferenceKind:   config.PreferenceKind,
+		MachineType:      config.MachineType,
+		Networks:         config.Networks,
+	}
+
+	if instanceType == "" {
+		vmConfig.CPU = config.CPU
+		vmConfig.Memory = config.Memory
+	}
+
+	vm, err := virtualMachine(vmConfig, "")
+	if err != nil {
+		return nil, err
+	}
+
+	rootdisk := uint(1)
+	disks := []v1.Disk{
 		{
 			Name: "rootdisk",
 			DiskDevice: v1.DiskDevice{
@@ -214,50 +665,113 @@ func getLinuxVirtualMachineDisks() []v1.Disk {
 			BootOrder: &rootdisk,
 		},
 	}
-}
+	sources := map[string]string{"rootdisk": config.Name}
+	sizes := map[string]string{"rootdisk": config.outputDiskSize()}
 
-func getLinuxVirtualMachineVolumes(name, isoVolumeName string) []v1.Volume {
-	return []v1.Volume{
-		{
-			Name: "cdrom",
-			VolumeSource: v1.VolumeSource{
-				DataVolume: &v1.DataVolumeSource{
-					Name: isoVolumeName,
+	for _, d := range config.Disks {
+		if !d.Output {
+			continue
+		}
+		disks = append(disks, v1.Disk{
+			Name: d.Name,
+			DiskDevice: v1.DiskDevice{
+				Disk: &v1.DiskTarget{Bus: v1.DiskBus(d.Bus)},
+			},
+			Serial: d.Serial,
+		})
+		sources[d.Name] = config.Name + "-" + d.Name
+		sizes[d.Name] = d.Blank.Size
+	}
+
+	var dataVolumeTemplates []v1.DataVolumeTemplateSpec
+	var volumes []v1.Volume
+
+	for _, d := range disks {
+		size, err := resource.ParseQuantity(sizes[d.Name])
+		if err != nil {
+			return nil, fmt.Errorf("disk %q: %w", d.Name, err)
+		}
+
+		dataVolumeName := name + "-" + d.Name
+		dataVolumeTemplates = append(dataVolumeTemplates, v1.DataVolumeTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: dataVolumeName,
+			},
+			Spec: cdiv1.DataVolumeSpec{
+				SourceRef: &cdiv1.DataVolumeSourceRef{
+					Kind:      cdiv1.DataVolumeDataSource,
+					Name:      sources[d.Name],
+					Namespace: ptr.To(namespace),
+				},
+				Storage: &cdiv1.StorageSpec{
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceName(corev1.ResourceStorage): size,
+						},
+					},
 				},
 			},
-		},
-		{
-			Name: "rootdisk",
+		})
+		volumes = append(volumes, v1.Volume{
+			Name: d.Name,
 			VolumeSource: v1.VolumeSource{
 				DataVolume: &v1.DataVolumeSource{
-					Name: name + "-rootdisk",
+					Name: dataVolumeName,
 				},
 			},
+		})
+	}
+
+	vm.Spec.RunStrategy = ptr.To(v1.RunStrategyHalted)
+	vm.Spec.DataVolumeTemplates = dataVolumeTemplates
+	vm.Spec.Template.Spec.Domain.Devices.Disks = disks
+	vm.Spec.Template.Spec.Volumes = volumes
+	return vm, nil
+}
+
+// openshiftTemplate wraps a VirtualMachine into an OpenShift Template,
+// with its name given by the NAME parameter.
+func openshiftTemplate(name string, vm *v1.VirtualMachine) (*templatev1.Template, error) {
+	raw, err := json.Marshal(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &templatev1.Template{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: templatev1.GroupVersion.String(),
+			Kind:       "Template",
 		},
-		{
-			Name: "oemdrv",
-			VolumeSource: v1.VolumeSource{
-				ConfigMap: &v1.ConfigMapVolumeSource{
-					LocalObjectReference: corev1.LocalObjectReference{
-						Name: name,
-					},
-					VolumeLabel: "OEMDRV",
-				},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Objects: []runtime.RawExtension{
+			{Raw: raw},
+		},
+		Parameters: []templatev1.Parameter{
+			{
+				Name:        "NAME",
+				Description: "Name of the VirtualMachine.",
+				Required:    true,
 			},
 		},
-	}
+	}, nil
 }
 
-func getWindowsVirtualMachineDisks() []v1.Disk {
+// osProfileLayout returns the disks and volumes of the temporary VM laid out by the OS profile:
+// the installation ISO, the root disk, the media files and the VirtIO drivers.
+func osProfileLayout(config Config, profile OSProfile, mediaVolumeName string) ([]v1.Disk, []v1.Volume) {
 	rootdisk := uint(1)
 	cdrom := uint(2)
+	oemdrv := uint(3)
 
-	return []v1.Disk{
+	disks := []v1.Disk{
 		{
 			Name: "cdrom",
 			DiskDevice: v1.DiskDevice{
 				CDRom: &v1.CDRomTarget{
-					Bus: "sata",
+					Bus:  v1.DiskBus(profile.CDRomBus),
+					Tray: "closed",
 				},
 			},
 			BootOrder: &cdrom,
@@ -265,36 +779,20 @@ func getWindowsVirtualMachineDisks() []v1.Disk {
 		{
 			Name: "rootdisk",
 			DiskDevice: v1.DiskDevice{
-				Disk: &v1.DiskTarget{},
-			},
-			BootOrder: &rootdisk,
-		},
-		{
-			Name: "virtiocontainerdisk",
-			DiskDevice: v1.DiskDevice{
-				CDRom: &v1.CDRomTarget{
-					Bus: "sata",
-				},
-			},
-		},
-		{
-			Name: "sysprep",
-			DiskDevice: v1.DiskDevice{
-				CDRom: &v1.CDRomTarget{
-					Bus: "sata",
+				Disk: &v1.DiskTarget{
+					Bus: v1.DiskBus(profile.DiskBus),
 				},
 			},
+			BootOrder: &rootdisk,
 		},
 	}
-}
 
-func getWindowsVirtualMachineVolumes(name, isoVolumeName string) []v1.Volume {
-	return []v1.Volume{
+	volumes := []v1.Volume{
 		{
 			Name: "cdrom",
 			VolumeSource: v1.VolumeSource{
 				DataVolume: &v1.DataVolumeSource{
-					Name: isoVolumeName,
+					Name: isoVolumeName(config),
 				},
 			},
 		},
@@ -302,27 +800,114 @@ func getWindowsVirtualMachineVolumes(name, isoVolumeName string) []v1.Volume {
 			Name: "rootdisk",
 			VolumeSource: v1.VolumeSource{
 				DataVolume: &v1.DataVolumeSource{
-					Name: name + "-rootdisk",
+					Name: diskVolumeName(config.buildName(), "root"),
 				},
 			},
 		},
-		{
+	}
+
+	switch profile.Media {
+	case "", "cdrom":
+		disks = append(disks, v1.Disk{
+			Name: "oemdrv",
+			DiskDevice: v1.DiskDevice{
+				CDRom: &v1.CDRomTarget{
+					Bus:  v1.DiskBus(profile.CDRomBus),
+					Tray: "closed",
+				},
+			},
+			BootOrder: &oemdrv,
+		})
+		volumes = append(volumes, v1.Volume{
+			Name:         "oemdrv",
+			VolumeSource: mediaCDRomVolumeSource(config, mediaVolumeName),
+		})
+	case "sysprep":
+		disks = append(disks, v1.Disk{
 			Name: "sysprep",
-			VolumeSource: v1.VolumeSource{
-				Sysprep: &v1.SysprepSource{
-					ConfigMap: &corev1.LocalObjectReference{
-						Name: name,
-					},
+			DiskDevice: v1.DiskDevice{
+				CDRom: &v1.CDRomTarget{
+					Bus: v1.DiskBus(profile.CDRomBus),
 				},
 			},
-		},
-		{
+		})
+		volumes = append(volumes, v1.Volume{
+			Name:         "sysprep",
+			VolumeSource: mediaSysprepVolumeSource(config, mediaVolumeName),
+		})
+	}
+
+	if source := virtioVolumeSource(config); profile.VirtioDrivers && source != nil {
+		disks = append(disks, v1.Disk{
 			Name: "virtiocontainerdisk",
-			VolumeSource: v1.VolumeSource{
-				ContainerDisk: &v1.ContainerDiskSource{
-					Image: "quay.io/kubevirt/virtio-container-disk:v1.5.2",
+			DiskDevice: v1.DiskDevice{
+				CDRom: &v1.CDRomTarget{
+					Bus: v1.DiskBus(profile.CDRomBus),
+				},
+			},
+		})
+		volumes = append(volumes, v1.Volume{
+			Name:         "virtiocontainerdisk",
+			VolumeSource: *source,
+		})
+	}
+	return disks, volumes
+}
+
+// mediaCDRomVolumeSource returns the source of the labelled CD-ROM providing the media files.
+func mediaCDRomVolumeSource(config Config, mediaVolumeName string) v1.VolumeSource {
+	if mediaVolumeName != "" {
+		return v1.VolumeSource{
+			DataVolume: &v1.DataVolumeSource{
+				Name: mediaVolumeName,
+			},
+		}
+	}
+
+	if config.MediaFilesSecret {
+		return v1.VolumeSource{
+			Secret: &v1.SecretVolumeSource{
+				SecretName:  config.buildName(),
+				VolumeLabel: config.mediaVolumeLabel(),
+			},
+		}
+	}
+
+	return v1.VolumeSource{
+		ConfigMap: &v1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{
+				Name: config.buildName(),
+			},
+			VolumeLabel: config.mediaVolumeLabel(),
+		},
+	}
+}
+
+// mediaSysprepVolumeSource returns the source of the sysprep volume providing the media files.
+func mediaSysprepVolumeSource(config Config, mediaVolumeName string) v1.VolumeSource {
+	if mediaVolumeName != "" {
+		return v1.VolumeSource{
+			DataVolume: &v1.DataVolumeSource{
+				Name: mediaVolumeName,
+			},
+		}
+	}
+
+	if config.MediaFilesSecret {
+		return v1.VolumeSource{
+			Sysprep: &v1.SysprepSource{
+				Secret: &corev1.LocalObjectReference{
+					Name: config.buildName(),
 				},
 			},
+		}
+	}
+
+	return v1.VolumeSource{
+		Sysprep: &v1.SysprepSource{
+			ConfigMap: &corev1.LocalObjectReference{
+				Name: config.buildName(),
+			},
 		},
 	}
 }
@@ -349,3 +934,290 @@ func convertToNetwork(n Network) (v1.Network, v1.Interface) {
 	}
 	return vmNetwork, vmInterface
 }
+
+func convertToDisk(name string, d Disk) (v1.Disk, v1.Volume, error) {
+	vmDisk := v1.Disk{Name: d.Name, Serial: d.Serial}
+	vmVolume := v1.Volume{Name: d.Name}
+
+	if d.BootOrder > 0 {
+		vmDisk.BootOrder = ptr.To(uint(d.BootOrder))
+	}
+
+	switch d.Type {
+	case "cdrom":
+		vmDisk.DiskDevice.CDRom = &v1.CDRomTarget{Bus: v1.DiskBus(d.Bus)}
+	case "", "disk":
+		vmDisk.DiskDevice.Disk = &v1.DiskTarget{Bus: v1.DiskBus(d.Bus)}
+	default:
+		return vmDisk, vmVolume, fmt.Errorf("disk %q: type %q is not supported", d.Name, d.Type)
+	}
+
+	switch {
+	case d.Blank != nil:
+		// Blank volume, created as a DataVolume template of the VM.
+		vmVolume.VolumeSource.DataVolume = &v1.DataVolumeSource{
+			Name: diskVolumeName(name, d.Name),
+		}
+	case d.PersistentVolumeClaim != nil:
+		vmVolume.VolumeSource.PersistentVolumeClaim = &v1.PersistentVolumeClaimVolumeSource{
+			PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: d.PersistentVolumeClaim.ClaimName,
+				ReadOnly:  d.PersistentVolumeClaim.ReadOnly,
+			},
+		}
+	case d.Secret != nil:
+		vmVolume.VolumeSource.Secret = &v1.SecretVolumeSource{
+			SecretName:  d.Secret.SecretName,
+			VolumeLabel: d.Secret.VolumeLabel,
+		}
+	case d.ContainerDisk != nil:
+		vmVolume.VolumeSource.ContainerDisk = &v1.ContainerDiskSource{
+			Image:           d.ContainerDisk.Image,
+			ImagePullSecret: d.ContainerDisk.ImagePullSecret,
+			Path:            d.ContainerDisk.Path,
+		}
+	default:
+		return vmDisk, vmVolume, fmt.Errorf("disk %q: no volume source defined", d.Name)
+	}
+	return vmDisk, vmVolume, nil
+}
+
+// customizePod returns a Pod running the customize commands against the root disk,
+// attached either as a block device or as a disk image on a filesystem.
+func customizePod(config Config, name string, volumeMode *corev1.PersistentVolumeMode) (*corev1.Pod, error) {
+	return libguestfsPod(config, name, config.customizeCommands(), rootDiskVolume(config, volumeMode))
+}
+
+// measurePod returns a Pod measuring the root disk. It writes the end of the last partition
+// and the space used by the guest filesystems, in bytes, to its termination message.
+func measurePod(config Config, name string, volumeMode *corev1.PersistentVolumeMode) (*corev1.Pod, error) {
+	commands := []string{
+		`used=$(virt-df --format=raw --csv -a "$DISK" | awk -F, 'NR > 1 { used += $4 } END { printf "%.0f", used * 1024 }')`,
+		`end=$(guestfish --ro --format=raw -a "$DISK" run : part-list /dev/sda | awk '$1 == "part_end:" && $2 + 1 > end { end = $2 + 1 } END { printf "%.0f", end }')`,
+		`echo "$end $used" > /dev/termination-log`,
+	}
+	return libguestfsPod(config, name, commands, rootDiskVolume(config, volumeMode))
+}
+
+// shrinkPod returns a Pod copying the partitions of the root disk into the smaller output disk
+// with virt-resize.
+func shrinkPod(config Config, name string, volumeMode, outputVolumeMode *corev1.PersistentVolumeMode) (*corev1.Pod, error) {
+	commands := []string{`virt-resize --format raw --output-format raw "$DISK" "$OUTPUT_DISK"`}
+	output := libguestfsVolume{
+		Name:       "outputdisk",
+		ClaimName:  diskVolumeName(config.buildName(), "output"),
+		VolumeMode: outputVolumeMode,
+		MountPath:  "/output",
+		Env:        "OUTPUT_DISK",
+	}
+	return libguestfsPod(config, name, commands, rootDiskVolume(config, volumeMode), output)
+}
+
+// libguestfsVolume is a volume attached to a libguestfs Pod, either as a block device
+// or as a disk image on a filesystem. The path of the disk is set in the Env variable.
+type libguestfsVolume struct {
+	Name       string
+	ClaimName  string
+	VolumeMode *corev1.PersistentVolumeMode
+	MountPath  string
+	Env        string
+}
+
+// rootDiskVolume returns the root disk of the build, attached to a libguestfs Pod.
+func rootDiskVolume(config Config, volumeMode *corev1.PersistentVolumeMode) libguestfsVolume {
+	return libguestfsVolume{
+		Name:       "rootdisk",
+		ClaimName:  diskVolumeName(config.buildName(), "root"),
+		VolumeMode: volumeMode,
+		MountPath:  "/disk",
+		Env:        "DISK",
+	}
+}
+
+// libguestfsPod returns a Pod running the commands in the customize image, with the volumes attached.
+func libguestfsPod(config Config, name string, commands []string, volumes ...libguestfsVolume) (*corev1.Pod, error) {
+	image := config.CustomizeImage
+	if image == "" {
+		image = defaultCustomizeImage
+	}
+
+	podAffinity, err := affinity(config.Affinity)
+	if err != nil {
+		return nil, err
+	}
+
+	container := corev1.Container{
+		Name:    "customize",
+		Image:   image,
+		Command: []string{"/bin/sh", "-e", "-x", "-c", strings.Join(commands, "\n")},
+		Env: []corev1.EnvVar{
+			{Name: "LIBGUESTFS_BACKEND", Value: "direct"},
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				"devices.kubevirt.io/kvm": resource.MustParse("1"),
+			},
+		},
+	}
+
+	var podVolumes []corev1.Volume
+	for _, v := range volumes {
+		disk := v.MountPath + "/disk.img"
+		if v.VolumeMode != nil && *v.VolumeMode == corev1.PersistentVolumeBlock {
+			disk = "/dev/" + v.Name
+			container.VolumeDevices = append(container.VolumeDevices, corev1.VolumeDevice{Name: v.Name, DevicePath: disk})
+		} else {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: v.Name, MountPath: v.MountPath})
+		}
+		container.Env = append(container.Env, corev1.EnvVar{Name: v.Env, Value: disk})
+
+		podVolumes = append(podVolumes, corev1.Volume{
+			Name: v.Name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: v.ClaimName,
+				},
+			},
+		})
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:     corev1.RestartPolicyNever,
+			NodeSelector:      config.NodeSelector,
+			Tolerations:       convertToTolerations(config.Tolerations),
+			Affinity:          podAffinity,
+			PriorityClassName: config.PriorityClassName,
+			Containers:        []corev1.Container{container},
+			Volumes:           podVolumes,
+		},
+	}, nil
+}
+
+// virtioVolumeSource returns the source of the VirtIO drivers attached to Windows VMs,
+// or nil if the drivers are disabled.
+func virtioVolumeSource(config Config) *v1.VolumeSource {
+	if config.DisableVirtioDrivers {
+		return nil
+	}
+
+	if config.VirtioClaimName != "" {
+		return &v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: config.VirtioClaimName,
+					ReadOnly:  true,
+				},
+			},
+		}
+	}
+
+	image := config.VirtioContainerImage
+	if image == "" {
+		image = defaultVirtioContainerImage
+	}
+	return &v1.VolumeSource{
+		ContainerDisk: &v1.ContainerDiskSource{
+			Image: image,
+		},
+	}
+}
+
+// convertToCloudInit returns the disk and volume providing the cloud-init data source.
+func convertToCloudInit(c CloudInit) (v1.Disk, v1.Volume) {
+	var userDataSecretRef, networkDataSecretRef *corev1.LocalObjectReference
+	if c.UserDataSecretRef != "" {
+		userDataSecretRef = &corev1.LocalObjectReference{Name: c.UserDataSecretRef}
+	}
+	if c.NetworkDataSecretRef != "" {
+		networkDataSecretRef = &corev1.LocalObjectReference{Name: c.NetworkDataSecretRef}
+	}
+
+	source := v1.VolumeSource{
+		CloudInitNoCloud: &v1.CloudInitNoCloudSource{
+			UserData:             c.UserData,
+			UserDataSecretRef:    userDataSecretRef,
+			NetworkData:          c.NetworkData,
+			NetworkDataSecretRef: networkDataSecretRef,
+		},
+	}
+
+	if c.Type == "ConfigDrive" {
+		source = v1.VolumeSource{
+			CloudInitConfigDrive: &v1.CloudInitConfigDriveSource{
+				UserData:             c.UserData,
+				UserDataSecretRef:    userDataSecretRef,
+				NetworkData:          c.NetworkData,
+				NetworkDataSecretRef: networkDataSecretRef,
+			},
+		}
+	}
+
+	disk := v1.Disk{
+		Name: "cloudinit",
+		DiskDevice: v1.DiskDevice{
+			Disk: &v1.DiskTarget{},
+		},
+	}
+	return disk, v1.Volume{Name: "cloudinit", VolumeSource: source}
+}
+
+// convertToCloudInitMetaData returns the hostname and the SSH public keys of the VM,
+// which KubeVirt sets in the generated cloud-init meta data.
+func convertToCloudInitMetaData(md *CloudInitMetaData) (string, []v1.AccessCredential) {
+	if md == nil {
+		return "", nil
+	}
+
+	var accessCredentials []v1.AccessCredential
+	if md.PublicKeysSecretRef != "" {
+		accessCredentials = append(accessCredentials, v1.AccessCredential{
+			SSHPublicKey: &v1.SSHPublicKeyAccessCredential{
+				Source: v1.SSHPublicKeyAccessCredentialSource{
+					Secret: &v1.AccessCredentialSecretSource{
+						SecretName: md.PublicKeysSecretRef,
+					},
+				},
+				PropagationMethod: v1.SSHPublicKeyAccessCredentialPropagationMethod{
+					ConfigDrive: &v1.ConfigDriveSSHPublicKeyAccessCredentialPropagation{},
+				},
+			},
+		})
+	}
+	return md.LocalHostname, accessCredentials
+}
+
+func convertToTolerations(tolerations []Toleration) []corev1.Toleration {
+	if len(tolerations) == 0 {
+		return nil
+	}
+
+	vmTolerations := make([]corev1.Toleration, len(tolerations))
+	for i, t := range tolerations {
+		vmTolerations[i] = corev1.Toleration{
+			Key:               t.Key,
+			Operator:          corev1.TolerationOperator(t.Operator),
+			Value:             t.Value,
+			Effect:            corev1.TaintEffect(t.Effect),
+			TolerationSeconds: t.TolerationSeconds,
+		}
+	}
+	return vmTolerations
+}
+
+// affinity decodes a YAML or JSON encoded Kubernetes affinity.
+// An empty string results in no affinity.
+func affinity(raw string) (*corev1.Affinity, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	vmAffinity := &corev1.Affinity{}
+	if err := yaml.UnmarshalStrict([]byte(raw), vmAffinity); err != nil {
+		return nil, err
+	}
+	return vmAffinity, nil
+}
@@ -24,8 +24,8 @@ type StepBootCommand struct {
 
 func (s *StepBootCommand) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	name := s.config.Name
-	namespace := s.config.Namespace
+	name := s.config.buildName()
+	namespace := s.config.buildNamespace()
 	bootCommand := strings.Join(s.config.BootCommand, "")
 	bootWait := s.config.BootWait
 
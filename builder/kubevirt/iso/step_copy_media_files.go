@@ -5,47 +5,166 @@ package iso
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+
+	"kubevirt.io/client-go/kubecli"
 )
 
 type StepCopyMediaFiles struct {
 	Config Config
 	Client kubernetes.Interface
+	// VirtClient is used to upload the media files as an ISO image,
+	// when they do not fit in a ConfigMap or Secret.
+	VirtClient kubecli.KubevirtClient
+
+	createCD *commonsteps.StepCreateCD
 }
 
 func (s *StepCopyMediaFiles) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	name := s.Config.Name
-	namespace := s.Config.Namespace
-	mediaFiles := s.Config.MediaFiles
+	name := s.Config.buildName()
+	namespace := s.Config.buildNamespace()
 
-	ui.Sayf("Creating a new ConfigMap to store media files (%s/%s)...", namespace, name)
-
-	configMap, err := configMap(name, mediaFiles)
+	files, err := readMedia(s.Config)
 	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	_, err = s.Client.CoreV1().ConfigMaps(namespace).Create(ctx, configMap, metav1.CreateOptions{})
+	if uploadMedia(s.Config, files) {
+		if err := s.uploadMediaFiles(ctx, state, files); err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	}
+
+	lease, _ := state.Get("build_lease").(*corev1.ConfigMap)
+
+	if s.Config.MediaFilesSecret {
+		ui.Sayf("Creating a new Secret to store media files (%s/%s)...", namespace, name)
+
+		mediaSecret := secret(name, files)
+		mediaSecret.OwnerReferences = ownerReferences(lease)
+
+		_, err = s.Client.CoreV1().Secrets(namespace).Create(ctx, mediaSecret, metav1.CreateOptions{})
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		trackResource(state, trackedResource{
+			Kind:      "Secret",
+			Namespace: namespace,
+			Name:      name,
+			Delete: func(ctx context.Context) error {
+				return s.Client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+			},
+		})
+		return multistep.ActionContinue
+	}
+
+	ui.Sayf("Creating a new ConfigMap to store media files (%s/%s)...", namespace, name)
+
+	mediaConfigMap := configMap(name, files)
+	mediaConfigMap.OwnerReferences = ownerReferences(lease)
+
+	_, err = s.Client.CoreV1().ConfigMaps(namespace).Create(ctx, mediaConfigMap, metav1.CreateOptions{})
 	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
+	trackResource(state, trackedResource{
+		Kind:      "ConfigMap",
+		Namespace: namespace,
+		Name:      name,
+		Delete: func(ctx context.Context) error {
+			return s.Client.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		},
+	})
 	return multistep.ActionContinue
 }
 
 func (s *StepCopyMediaFiles) Cleanup(state multistep.StateBag) {
+	if s.createCD != nil {
+		s.createCD.Cleanup(state)
+	}
+}
+
+// uploadMediaFiles builds an ISO image from the media files, preserving their paths,
+// and uploads it into a new DataVolume attached to the VM in place of the ConfigMap.
+func (s *StepCopyMediaFiles) uploadMediaFiles(ctx context.Context, state multistep.StateBag, files map[string][]byte) error {
 	ui := state.Get("ui").(packer.Ui)
-	name := s.Config.Name
-	namespace := s.Config.Namespace
+	namespace := s.Config.buildNamespace()
+	mediaVolumeName := diskVolumeName(s.Config.buildName(), "media")
 
-	ui.Sayf("Deleting ConfigMap (%s/%s)...", namespace, name)
+	content := make(map[string]string, len(files))
+	for relPath, data := range files {
+		content[relPath] = string(data)
+	}
+
+	s.createCD = &commonsteps.StepCreateCD{
+		Content: content,
+		Label:   s.Config.mediaVolumeLabel(),
+	}
+	if action := s.createCD.Run(ctx, state); action != multistep.ActionContinue {
+		if err, ok := state.Get("error").(error); ok {
+			return err
+		}
+		return fmt.Errorf("failed to create the media files ISO image")
+	}
+
+	info, err := os.Stat(s.createCD.CDPath)
+	if err != nil {
+		return err
+	}
+
+	uploadProxyURL := s.Config.MediaUploadProxyURL
+	if uploadProxyURL == "" {
+		cdiConfig, err := s.VirtClient.CdiClient().CdiV1beta1().CDIConfigs().Get(ctx, "config", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if cdiConfig.Status.UploadProxyURL == nil || *cdiConfig.Status.UploadProxyURL == "" {
+			return fmt.Errorf("CDI upload proxy URL is not set, set 'media_upload_proxy_url'")
+		}
+		uploadProxyURL = *cdiConfig.Status.UploadProxyURL
+	}
 
-	_ = s.Client.CoreV1().ConfigMaps(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	ui.Sayf("Uploading media files to a new DataVolume (%s/%s)...", namespace, mediaVolumeName)
+
+	lease, _ := state.Get("build_lease").(*corev1.ConfigMap)
+	dataVolume := uploadVolume(mediaVolumeName, info.Size())
+	dataVolume.OwnerReferences = ownerReferences(lease)
+
+	_, err = s.VirtClient.CdiClient().CdiV1beta1().DataVolumes(namespace).Create(ctx, dataVolume, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	trackResource(state, trackedResource{
+		Kind:      "DataVolume",
+		Namespace: namespace,
+		Name:      mediaVolumeName,
+		Delete: func(ctx context.Context) error {
+			return s.VirtClient.CdiClient().CdiV1beta1().DataVolumes(namespace).Delete(ctx, mediaVolumeName, metav1.DeleteOptions{})
+		},
+	})
+	state.Put("media_files_volume_name", mediaVolumeName)
+
+	if err := WaitUntilDataVolumeUploadReady(ctx, s.VirtClient, namespace, mediaVolumeName); err != nil {
+		return err
+	}
+
+	if err := UploadToDataVolume(ctx, s.VirtClient, namespace, mediaVolumeName, uploadProxyURL, s.Config.MediaUploadInsecure, s.createCD.CDPath); err != nil {
+		return err
+	}
+	return WaitUntilDataVolumeSucceeded(ctx, s.VirtClient, namespace, mediaVolumeName)
 }
@@ -6,13 +6,18 @@ package iso_test
 import (
 	"context"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/golang/mock/gomock"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	packerssh "github.com/hashicorp/packer-plugin-sdk/communicator/ssh"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 
@@ -23,6 +28,11 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	fakek8sclient "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/testing"
+
+	fakecdiclient "kubevirt.io/client-go/containerizeddataimporter/fake"
+	"kubevirt.io/client-go/kubecli"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
 )
 
 var _ = Describe("StepCopyMediaFiles", func() {
@@ -35,10 +45,11 @@ var _ = Describe("StepCopyMediaFiles", func() {
 		state      *multistep.BasicStateBag
 		step       *iso.StepCopyMediaFiles
 		kubeClient *fakek8sclient.Clientset
+		uiErr      *strings.Builder
 	)
 
 	BeforeEach(func() {
-		uiErr := &strings.Builder{}
+		uiErr = &strings.Builder{}
 		ui := &packer.BasicUi{
 			Reader:      strings.NewReader(""),
 			Writer:      io.Discard,
@@ -79,6 +90,167 @@ var _ = Describe("StepCopyMediaFiles", func() {
 			Expect(cm.Data).To(HaveKey("file2.iso"))
 		})
 
+		It("sets the build lease as the owner of the ConfigMap", func() {
+			err := os.WriteFile("file1.iso", []byte("fake iso data 1"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = os.WriteFile("file2.iso", []byte("fake iso data 2"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			defer os.Remove("file1.iso")
+			defer os.Remove("file2.iso")
+
+			state.Put("build_lease", &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name + "-lease", UID: "lease-uid"},
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cm.OwnerReferences).To(ConsistOf(metav1.OwnerReference{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+				Name:       name + "-lease",
+				UID:        "lease-uid",
+			}))
+		})
+
+		It("stores non UTF-8 files as binary data", func() {
+			err := os.WriteFile("file1.iso", []byte("fake iso data 1"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = os.WriteFile("file2.iso", []byte{0xff, 0xfe, 0x00, 0x01}, 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			defer os.Remove("file1.iso")
+			defer os.Remove("file2.iso")
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cm.Data).To(HaveKeyWithValue("file1.iso", "fake iso data 1"))
+			Expect(cm.BinaryData).To(HaveKeyWithValue("file2.iso", []byte{0xff, 0xfe, 0x00, 0x01}))
+		})
+
+		It("continues when Secret is created successfully", func() {
+			step.Config.MediaFilesSecret = true
+
+			err := os.WriteFile("file1.iso", []byte("fake iso data 1"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = os.WriteFile("file2.iso", []byte("fake iso data 2"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			defer os.Remove("file1.iso")
+			defer os.Remove("file2.iso")
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secret.Data).To(HaveKeyWithValue("file1.iso", []byte("fake iso data 1")))
+			Expect(secret.Data).To(HaveKey("file2.iso"))
+
+			_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("expands glob patterns into the ConfigMap", func() {
+			dir := GinkgoT().TempDir()
+			err := os.WriteFile(filepath.Join(dir, "ks.cfg"), []byte("kickstart"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = os.WriteFile(filepath.Join(dir, "post.sh"), []byte("post"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			step.Config.MediaFiles = []string{filepath.Join(dir, "*")}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cm.Data).To(HaveKeyWithValue("ks.cfg", "kickstart"))
+			Expect(cm.Data).To(HaveKeyWithValue("post.sh", "post"))
+		})
+
+		It("halts when media files have the same path", func() {
+			dir := GinkgoT().TempDir()
+			for _, sub := range []string{"a", "b"} {
+				Expect(os.Mkdir(filepath.Join(dir, sub), 0755)).To(Succeed())
+				err := os.WriteFile(filepath.Join(dir, sub, "setup.ps1"), []byte(sub), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			step.Config.MediaFiles = []string{filepath.Join(dir, "a", "setup.ps1"), filepath.Join(dir, "b", "setup.ps1")}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring("have the same path \"setup.ps1\""))
+
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("renders media templates and content with the build variables", func() {
+			dir := GinkgoT().TempDir()
+			template := filepath.Join(dir, "ks.cfg")
+			err := os.WriteFile(template, []byte("network --hostname={{ .Name }}"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			step.Config.MediaFiles = nil
+			step.Config.MediaTemplates = []string{template}
+			step.Config.MediaContent = map[string]string{
+				"user.txt": "{{ .SSHUsername }}:{{ .SSHPassword }}",
+			}
+			step.Config.SSHUsername = "admin"
+			step.Config.SSHPassword = "secret"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cm.Data).To(HaveKeyWithValue("ks.cfg", "network --hostname="+name))
+			Expect(cm.Data).To(HaveKeyWithValue("user.txt", "admin:secret"))
+		})
+
+		It("renders the SSH public key of the build", func() {
+			keyPair, err := packerssh.NewKeyPair(packerssh.CreateKeyPairConfig{Comment: "packer"})
+			Expect(err).NotTo(HaveOccurred())
+			keyFile := filepath.Join(GinkgoT().TempDir(), "id_ecdsa")
+			Expect(os.WriteFile(keyFile, keyPair.PrivateKeyPemBlock, 0600)).To(Succeed())
+
+			step.Config, err = step.Config.WithSSHPrivateKeyFile(keyFile)
+			Expect(err).NotTo(HaveOccurred())
+			step.Config.MediaFiles = nil
+			step.Config.MediaContent = map[string]string{"authorized_keys": "{{ .SSHPublicKey }}"}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			// The comment of the key pair is not stored in the private key.
+			publicKey := strings.TrimSuffix(strings.TrimSpace(string(keyPair.PublicKeyAuthorizedKeysLine)), " packer")
+			Expect(cm.Data).To(HaveKeyWithValue("authorized_keys", publicKey))
+		})
+
+		It("halts when media content conflicts with a media file", func() {
+			dir := GinkgoT().TempDir()
+			file := filepath.Join(dir, "ks.cfg")
+			err := os.WriteFile(file, []byte("kickstart"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			step.Config.MediaFiles = []string{file}
+			step.Config.MediaContent = map[string]string{"ks.cfg": "other"}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring("conflicts with a media file"))
+		})
+
 		It("halts when ConfigMap creation fails due to invalid media files", func() {
 			// Simulate invalid media file by injecting empty name
 			step.Config.MediaFiles = []string{""}
@@ -99,23 +271,171 @@ var _ = Describe("StepCopyMediaFiles", func() {
 		})
 	})
 
+	Context("ISO image", func() {
+		var (
+			cdiClient *fakecdiclient.Clientset
+			ctrl      *gomock.Controller
+			dir       string
+			uploaded  int64
+		)
+
+		BeforeEach(func() {
+			// Replace xorriso with a script writing a 3MB image and recording its arguments.
+			dir = GinkgoT().TempDir()
+			script := "#!/bin/sh\n" +
+				"echo \"$@\" > " + filepath.Join(dir, "args") + "\n" +
+				"while [ $# -gt 0 ]; do [ \"$1\" = -output ] && dest=\"$2\"; shift; done\n" +
+				"head -c 3000000 /dev/zero > \"$dest\"\n"
+			Expect(os.WriteFile(filepath.Join(dir, "xorriso"), []byte(script), 0755)).To(Succeed())
+			GinkgoT().Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			cdiClient = fakecdiclient.NewSimpleClientset()
+			cdiClient.PrependReactor("create", "datavolumes", func(action testing.Action) (bool, runtime.Object, error) {
+				dv := action.(testing.CreateAction).GetObject().(*cdiv1beta1.DataVolume)
+				dv.Status.Phase = cdiv1beta1.UploadReady
+				return false, dv, nil
+			})
+			cdiClient.PrependReactor("create", "uploadtokenrequests", func(action testing.Action) (bool, runtime.Object, error) {
+				request := action.(testing.CreateAction).GetObject().(*uploadv1beta1.UploadTokenRequest)
+				request.Status.Token = "upload-token"
+				return true, request, nil
+			})
+
+			// The upload proxy marks the DataVolume as succeeded once the image is uploaded.
+			uploaded = 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.URL.Path).To(Equal("/v1beta1/upload"))
+				Expect(r.Header.Get("Authorization")).To(Equal("Bearer upload-token"))
+				uploaded, _ = io.Copy(io.Discard, r.Body)
+
+				dataVolumes := cdiClient.CdiV1beta1().DataVolumes(namespace)
+				dv, err := dataVolumes.Get(r.Context(), name+"-mediadisk", metav1.GetOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				dv.Status.Phase = cdiv1beta1.Succeeded
+				_, err = dataVolumes.Update(r.Context(), dv, metav1.UpdateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}))
+			DeferCleanup(server.Close)
+
+			ctrl = gomock.NewController(GinkgoT())
+			kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
+			kubecli.MockKubevirtClientInstance = kubecli.NewMockKubevirtClient(ctrl)
+			kubecli.MockKubevirtClientInstance.EXPECT().CdiClient().Return(cdiClient).AnyTimes()
+			step.VirtClient, _ = kubecli.GetKubevirtClientFromClientConfig(nil)
+
+			step.Config.MediaFiles = nil
+			step.Config.MediaUploadProxyURL = server.URL
+			DeferCleanup(step.Cleanup, state)
+		})
+
+		AfterEach(func() {
+			ctrl.Finish()
+		})
+
+		// expectUploaded checks that the ISO image was uploaded into the media DataVolume, with headroom.
+		expectUploaded := func() {
+			Expect(uploaded).To(Equal(int64(3000000)))
+			Expect(state.Get("media_files_volume_name")).To(Equal(name + "-mediadisk"))
+
+			dv, err := cdiClient.CdiV1beta1().DataVolumes(namespace).Get(context.Background(), name+"-mediadisk", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dv.Spec.Source.Upload).NotTo(BeNil())
+			Expect(dv.Spec.Storage.Resources.Requests.Storage().String()).To(Equal("4Mi"))
+
+			_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		}
+
+		It("uploads the media files when they exceed the size of a ConfigMap", func() {
+			step.Config.MediaContent = map[string]string{"ks.cfg": strings.Repeat("#", 1024*1024)}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			expectUploaded()
+
+			args, err := os.ReadFile(filepath.Join(dir, "args"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(args)).To(ContainSubstring("-volid OEMDRV"))
+		})
+
+		It("stores the media files in a ConfigMap up to the size of a ConfigMap", func() {
+			step.Config.MediaContent = map[string]string{"ks.cfg": strings.Repeat("#", 1024*1024-len("ks.cfg"))}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(uploaded).To(BeZero())
+
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("uploads the media files with media_files_iso", func() {
+			step.Config.MediaFilesISO = true
+			step.Config.MediaContent = map[string]string{"ks.cfg": "kickstart"}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			expectUploaded()
+		})
+
+		It("halts when the upload fails", func() {
+			step.Config.MediaFilesISO = true
+			step.Config.MediaContent = map[string]string{"ks.cfg": "kickstart"}
+			step.Config.MediaUploadProxyURL = "http://127.0.0.1:0"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+	})
+
 	Context("Cleanup", func() {
-		It("deletes ConfigMap successfully", func() {
-			// Pre-create ConfigMap
-			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Create(context.Background(), &corev1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      name,
-					Namespace: namespace,
-				},
-				Data: map[string]string{"file1.iso": "data"},
-			}, metav1.CreateOptions{})
+		var cleanup *iso.StepCreateBuildLease
+
+		BeforeEach(func() {
+			err := os.WriteFile("file1.iso", []byte("fake iso data 1"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = os.WriteFile("file2.iso", []byte("fake iso data 2"), 0644)
 			Expect(err).NotTo(HaveOccurred())
 
-			// Cleanup
+			DeferCleanup(os.Remove, "file1.iso")
+			DeferCleanup(os.Remove, "file2.iso")
+
+			// The resources tracked by the step are deleted by the build lease step.
+			cleanup = &iso.StepCreateBuildLease{Config: step.Config, Client: kubeClient}
+		})
+
+		It("deletes ConfigMap successfully", func() {
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+
 			step.Cleanup(state)
+			cleanup.Cleanup(state)
 
-			_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
 			Expect(err).To(HaveOccurred()) // Should be deleted
 		})
+
+		It("deletes Secret successfully", func() {
+			step.Config.MediaFilesSecret = true
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+
+			step.Cleanup(state)
+			cleanup.Cleanup(state)
+
+			_, err := kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("keeps ConfigMap when the build fails with keep_on_failure", func() {
+			cleanup.Config.KeepOnFailure = true
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+			state.Put(multistep.StateHalted, true)
+
+			step.Cleanup(state)
+			cleanup.Cleanup(state)
+
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
 	})
 })
@@ -5,13 +5,17 @@ package iso
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
 
 	"kubevirt.io/client-go/kubecli"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 )
 
 type StepCreateBootableVolume struct {
@@ -22,36 +26,206 @@ type StepCreateBootableVolume struct {
 func (s *StepCreateBootableVolume) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
 	name := s.Config.Name
-	namespace := s.Config.Namespace
-	diskSize := s.Config.DiskSize
-	instanceType := s.Config.InstanceType
-	preferenceName := s.Config.Preference
-	cloneVolume := cloneVolume(name, namespace, diskSize)
-	sourceVolume := sourceVolume(name, namespace, instanceType, preferenceName)
+	namespace := s.Config.outputNamespace()
+	buildName := s.Config.buildName()
+	buildNamespace := s.Config.buildNamespace()
+	diskSize := s.Config.outputDiskSize()
+	instanceType, preferenceName := s.Config.outputDefaults()
 
 	ui.Sayf("Creating a new bootable volume (%s/%s)...", namespace, name)
 
-	dv, err := s.Client.CdiClient().CdiV1beta1().DataVolumes(namespace).Create(ctx, cloneVolume, metav1.CreateOptions{})
-	if err != nil {
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+	// A shrunk root disk is cloned as is, at the size of the output disk.
+	rootVolumeName := diskVolumeName(buildName, "root")
+	if outputVolumeName, ok := state.Get("output_volume_name").(string); ok {
+		rootVolumeName, diskSize = outputVolumeName, ""
 	}
 
-	if err = WaitUntilDataVolumeSucceeded(ctx, s.Client, dv.Namespace, dv.Name); err != nil {
+	rootVolume, err := cloneVolume(name, buildNamespace, rootVolumeName, diskSize)
+	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	ds, err := s.Client.CdiClient().CdiV1beta1().DataSources(namespace).Create(ctx, sourceVolume, metav1.CreateOptions{})
+	ds, err := s.exportVolume(ctx, state, rootVolume, sourceVolume(name, namespace, instanceType, preferenceName), buildName)
 	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
+	disks := map[string]string{}
+	for _, d := range s.Config.Disks {
+		if !d.Output {
+			continue
+		}
+		diskName := name + "-" + d.Name
+
+		ui.Sayf("Creating a new volume of disk %q (%s/%s)...", d.Name, namespace, diskName)
+
+		diskVolume, err := cloneVolume(diskName, buildNamespace, diskVolumeName(buildName, d.Name), d.Blank.Size)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		diskSource, err := s.exportVolume(ctx, state, diskVolume, sourceVolume(diskName, namespace, "", ""), buildName+"-"+d.Name)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		disks[d.Name] = diskSource.Name
+	}
+
 	state.Put("bootable_volume_name", ds.Name)
+	state.Put("bootable_volume_disks", disks)
 	return multistep.ActionContinue
 }
 
 func (s *StepCreateBootableVolume) Cleanup(state multistep.StateBag) {
 	// Left blank intentionally
 }
+
+// exportVolume clones a disk of the temporary VM into a new DataVolume, and creates a DataSource
+// pointing to it once the clone has succeeded. The DataVolume is then deleted, orphaning its
+// PersistentVolumeClaim which the DataSource points to. The published resources are tracked,
+// so that they are deleted if the build fails.
+//
+// If the volume already exists and is to be replaced, the clone is named replacementName instead,
+// the existing DataSource is switched to it, and the previous volumes are deleted afterwards.
+func (s *StepCreateBootableVolume) exportVolume(ctx context.Context, state multistep.StateBag, cloneVolume *cdiv1.DataVolume, sourceVolume *cdiv1.DataSource, replacementName string) (*cdiv1.DataSource, error) {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.outputNamespace()
+	dataVolumes := s.Client.CdiClient().CdiV1beta1().DataVolumes(namespace)
+	dataSources := s.Client.CdiClient().CdiV1beta1().DataSources(namespace)
+
+	existing, previousVolumes, err := s.existingVolumes(ctx, sourceVolume.Name, cloneVolume.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil || len(previousVolumes) > 0 {
+		if !s.Config.force() {
+			return nil, fmt.Errorf("volume %s/%s already exists, set force or use -force to replace it", namespace, sourceVolume.Name)
+		}
+		if replacementName == cloneVolume.Name {
+			return nil, fmt.Errorf("volume %s/%s cannot be replaced by itself", namespace, replacementName)
+		}
+
+		ui.Sayf("Replacing the existing volume (%s/%s) with a new volume (%s/%s)...", namespace, sourceVolume.Name, namespace, replacementName)
+		cloneVolume.Name = replacementName
+		sourceVolume.Spec.Source.PVC.Name = replacementName
+	}
+
+	dv, err := dataVolumes.Create(ctx, cloneVolume, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	trackResource(state, trackedResource{
+		Kind:      "DataVolume",
+		Namespace: namespace,
+		Name:      dv.Name,
+		Output:    true,
+		Delete: func(ctx context.Context) error {
+			return dataVolumes.Delete(ctx, dv.Name, metav1.DeleteOptions{})
+		},
+	})
+
+	if err = WaitUntilDataVolumeSucceeded(ctx, s.Client, dv.Namespace, dv.Name); err != nil {
+		return nil, err
+	}
+
+	var ds *cdiv1.DataSource
+	if existing != nil {
+		// Switching the existing DataSource to the new volume, so that it never goes missing.
+		existing.Labels = sourceVolume.Labels
+		existing.Spec = sourceVolume.Spec
+
+		ds, err = dataSources.Update(ctx, existing, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ds, err = dataSources.Create(ctx, sourceVolume, metav1.CreateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		trackResource(state, trackedResource{
+			Kind:      "DataSource",
+			Namespace: namespace,
+			Name:      ds.Name,
+			Output:    true,
+			Delete: func(ctx context.Context) error {
+				return dataSources.Delete(ctx, ds.Name, metav1.DeleteOptions{})
+			},
+		})
+	}
+
+	// The DataVolume may already have been garbage collected by CDI.
+	err = dataVolumes.Delete(ctx, dv.Name, metav1.DeleteOptions{
+		PropagationPolicy: ptr.To(metav1.DeletePropagationOrphan),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	// Once the existing DataSource points to it, the new volume is no longer deleted on failure.
+	if existing == nil {
+		trackResource(state, trackedResource{
+			Kind:      "PersistentVolumeClaim",
+			Namespace: namespace,
+			Name:      dv.Name,
+			Output:    true,
+			Delete: func(ctx context.Context) error {
+				return s.Client.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, dv.Name, metav1.DeleteOptions{})
+			},
+		})
+	}
+
+	for _, name := range previousVolumes {
+		ui.Sayf("Deleting the previous volume (%s/%s)...", namespace, name)
+
+		if err := dataVolumes.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		err := s.Client.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+// existingVolumes returns the existing DataSource of a published volume, if any, along with the
+// names of the volumes to delete once it is replaced: the volume the DataSource points to, and
+// any DataVolume or PersistentVolumeClaim left with the name of the volume.
+func (s *StepCreateBootableVolume) existingVolumes(ctx context.Context, sourceName, volumeName string) (*cdiv1.DataSource, []string, error) {
+	namespace := s.Config.outputNamespace()
+	var volumes []string
+
+	ds, err := s.Client.CdiClient().CdiV1beta1().DataSources(namespace).Get(ctx, sourceName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		ds = nil
+	} else if err != nil {
+		return nil, nil, err
+	} else if pvc := ds.Spec.Source.PVC; pvc != nil && (pvc.Namespace == "" || pvc.Namespace == namespace) {
+		volumes = append(volumes, pvc.Name)
+	}
+
+	if len(volumes) > 0 && volumes[0] == volumeName {
+		return ds, volumes, nil
+	}
+
+	_, err = s.Client.CdiClient().CdiV1beta1().DataVolumes(namespace).Get(ctx, volumeName, metav1.GetOptions{})
+	if err == nil {
+		return ds, append(volumes, volumeName), nil
+	} else if !errors.IsNotFound(err) {
+		return nil, nil, err
+	}
+
+	_, err = s.Client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, volumeName, metav1.GetOptions{})
+	if err == nil {
+		return ds, append(volumes, volumeName), nil
+	} else if !errors.IsNotFound(err) {
+		return nil, nil, err
+	}
+	return ds, volumes, nil
+}
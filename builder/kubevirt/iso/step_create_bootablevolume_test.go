@@ -22,8 +22,10 @@ import (
 	"kubevirt.io/client-go/kubecli"
 	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	fakek8sclient "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/testing"
 )
 
@@ -38,9 +40,27 @@ var _ = Describe("StepCreateBootableVolume", func() {
 		state      *multistep.BasicStateBag
 		step       *iso.StepCreateBootableVolume
 		cdiClient  *fakecdiclient.Clientset
+		kubeClient *fakek8sclient.Clientset
 		virtClient kubecli.KubevirtClient
+		created    map[string]*cdiv1beta1.DataVolume
 	)
 
+	// succeedDataVolumes records the created DataVolumes, and stores them as succeeded
+	// along with their PersistentVolumeClaim.
+	succeedDataVolumes := func(ns string) testing.ReactionFunc {
+		return func(action testing.Action) (bool, runtime.Object, error) {
+			dv := action.(testing.CreateAction).GetObject().(*cdiv1beta1.DataVolume)
+			dv.Namespace = ns
+			dv.Status.Phase = cdiv1beta1.Succeeded
+			created[dv.Name] = dv.DeepCopy()
+			_ = cdiClient.Tracker().Add(dv)
+			_ = kubeClient.Tracker().Add(&corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: dv.Name, Namespace: ns},
+			})
+			return true, dv, nil
+		}
+	}
+
 	BeforeEach(func() {
 		uiErr := &strings.Builder{}
 		ui := &packer.BasicUi{
@@ -52,10 +72,13 @@ var _ = Describe("StepCreateBootableVolume", func() {
 		state.Put("ui", ui)
 
 		ctrl = gomock.NewController(GinkgoT())
+		created = map[string]*cdiv1beta1.DataVolume{}
 		cdiClient = fakecdiclient.NewSimpleClientset()
+		kubeClient = fakek8sclient.NewSimpleClientset()
 		kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
 		kubecli.MockKubevirtClientInstance = kubecli.NewMockKubevirtClient(ctrl)
 		kubecli.MockKubevirtClientInstance.EXPECT().CdiClient().Return(cdiClient).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().CoreV1().Return(kubeClient.CoreV1()).AnyTimes()
 		virtClient, _ = kubecli.GetKubevirtClientFromClientConfig(nil)
 
 		step = &iso.StepCreateBootableVolume{
@@ -102,6 +125,146 @@ var _ = Describe("StepCreateBootableVolume", func() {
 			Expect(state.Get("bootable_volume_name")).To(Equal("boot-dv"))
 		})
 
+		It("labels the DataSource with the default instance type and preference", func() {
+			step.Config.DefaultInstanceType = "u1.medium"
+
+			cdiClient.PrependReactor("create", "datavolumes", func(action testing.Action) (bool, runtime.Object, error) {
+				dv := action.(testing.CreateAction).GetObject().(*cdiv1beta1.DataVolume)
+				dv.Status.Phase = cdiv1beta1.Succeeded
+				_ = cdiClient.Tracker().Add(dv)
+				return true, dv, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			ds, err := cdiClient.CdiV1beta1().DataSources(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Labels).To(HaveKeyWithValue("instancetype.kubevirt.io/default-instancetype", "u1.medium"))
+			Expect(ds.Labels).To(HaveKeyWithValue("instancetype.kubevirt.io/default-preference", "fedora"))
+		})
+
+		It("exports additional output disks", func() {
+			step.Config.Disks = []iso.Disk{
+				{Name: "data", Output: true, VolumeSource: iso.VolumeSource{Blank: &iso.BlankVolume{Size: "5Gi"}}},
+				{Name: "scratch", VolumeSource: iso.VolumeSource{Blank: &iso.BlankVolume{Size: "5Gi"}}},
+			}
+
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(state.Get("bootable_volume_disks")).To(Equal(map[string]string{"data": name + "-data"}))
+
+			dv := created[name+"-data"]
+			Expect(dv).NotTo(BeNil())
+			Expect(dv.Spec.Source.PVC.Name).To(Equal(name + "-datadisk"))
+
+			_, err := cdiClient.CdiV1beta1().DataSources(namespace).Get(context.Background(), name+"-data", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created).NotTo(HaveKey(name + "-scratch"))
+		})
+
+		It("clones the root disk with the output disk size", func() {
+			step.Config.OutputDiskSize = "20Gi"
+
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			dv := created[name]
+			Expect(dv).NotTo(BeNil())
+			Expect(dv.Spec.PVC.Resources.Requests.Storage().String()).To(Equal("20Gi"))
+		})
+
+		It("clones the shrunk root disk at its own size", func() {
+			step.Config.OutputDiskSize = "minimal"
+			state.Put("output_volume_name", name+"-outputdisk")
+
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			dv := created[name]
+			Expect(dv).NotTo(BeNil())
+			Expect(dv.Spec.Source.PVC.Name).To(Equal(name + "-outputdisk"))
+			Expect(dv.Spec.PVC).To(BeNil())
+			Expect(dv.Spec.Storage).To(Equal(&cdiv1beta1.StorageSpec{}))
+		})
+
+		It("clones the root disk into the output namespace", func() {
+			step.Config.BuildNamespace = "packer-builds"
+			step.Config.OutputNamespace = "os-images"
+
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes("os-images"))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			dv := created[name]
+			Expect(dv).NotTo(BeNil())
+			Expect(dv.Spec.Source.PVC.Namespace).To(Equal("packer-builds"))
+			Expect(dv.Spec.Source.PVC.Name).To(Equal(name + "-rootdisk"))
+
+			ds, err := cdiClient.CdiV1beta1().DataSources("os-images").Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Spec.Source.PVC.Namespace).To(Equal("os-images"))
+		})
+
+		It("clones the root disk of the build into the published volume", func() {
+			step.Config = step.Config.WithBuildID("x7k2p")
+
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(state.Get("bootable_volume_name")).To(Equal(name))
+
+			dv := created[name]
+			Expect(dv).NotTo(BeNil())
+			Expect(dv.Spec.Source.PVC.Name).To(Equal(name + "-x7k2p-rootdisk"))
+		})
+
+		It("deletes the clone DataVolume and keeps its PersistentVolumeClaim", func() {
+			var propagation *metav1.DeletionPropagation
+			cdiClient.PrependReactor("delete", "datavolumes", func(action testing.Action) (bool, runtime.Object, error) {
+				propagation = action.(testing.DeleteAction).GetDeleteOptions().PropagationPolicy
+				return false, nil, nil
+			})
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			_, err := cdiClient.CdiV1beta1().DataVolumes(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(propagation).To(HaveValue(Equal(metav1.DeletePropagationOrphan)))
+
+			(&iso.StepCreateBuildLease{Config: step.Config, Client: kubeClient}).Cleanup(state)
+
+			_, err = kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = cdiClient.CdiV1beta1().DataSources(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("deletes the published volume when the build fails", func() {
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			state.Put(multistep.StateHalted, true)
+
+			(&iso.StepCreateBuildLease{Config: step.Config, Client: kubeClient}).Cleanup(state)
+
+			_, err := kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+			_, err = cdiClient.CdiV1beta1().DataSources(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+
 		It("halts when DataVolume creation fails", func() {
 			cdiClient.PrependReactor("create", "datavolumes", func(action testing.Action) (bool, runtime.Object, error) {
 				return true, nil, fmt.Errorf("boom: DV create failed")
@@ -112,16 +275,13 @@ var _ = Describe("StepCreateBootableVolume", func() {
 		})
 
 		It("halts when DataVolume does not succeed", func() {
-			_, err := cdiClient.CdiV1beta1().DataVolumes(namespace).Create(context.Background(), &cdiv1beta1.DataVolume{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      name,
-					Namespace: namespace,
-				},
-				Status: cdiv1beta1.DataVolumeStatus{
-					Phase: cdiv1beta1.Pending,
-				},
-			}, metav1.CreateOptions{})
-			Expect(err).NotTo(HaveOccurred())
+			cdiClient.PrependReactor("create", "datavolumes", func(action testing.Action) (bool, runtime.Object, error) {
+				dv := action.(testing.CreateAction).GetObject().(*cdiv1beta1.DataVolume)
+				dv.Namespace = namespace
+				dv.Status.Phase = cdiv1beta1.Pending
+				_ = cdiClient.Tracker().Add(dv)
+				return true, dv, nil
+			})
 
 			// Cancel context so wait ends
 			ctx, cancel := context.WithCancel(context.Background())
@@ -132,17 +292,7 @@ var _ = Describe("StepCreateBootableVolume", func() {
 		})
 
 		It("halts when DataSource creation fails", func() {
-			_, err := cdiClient.CdiV1beta1().DataVolumes(namespace).Create(context.Background(), &cdiv1beta1.DataVolume{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      name,
-					Namespace: namespace,
-				},
-				Status: cdiv1beta1.DataVolumeStatus{
-					Phase: cdiv1beta1.Succeeded,
-				},
-			}, metav1.CreateOptions{})
-			Expect(err).NotTo(HaveOccurred())
-
+			cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
 			cdiClient.PrependReactor("create", "datasources", func(action testing.Action) (bool, runtime.Object, error) {
 				return true, nil, fmt.Errorf("boom: DS create failed")
 			})
@@ -150,5 +300,73 @@ var _ = Describe("StepCreateBootableVolume", func() {
 			action := step.Run(context.Background(), state)
 			Expect(action).To(Equal(multistep.ActionHalt))
 		})
+
+		Context("when the volume already exists", func() {
+			BeforeEach(func() {
+				step.Config = step.Config.WithBuildID("x7k2p")
+
+				_, err := cdiClient.CdiV1beta1().DataSources(namespace).Create(context.Background(), &cdiv1beta1.DataSource{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+					Spec: cdiv1beta1.DataSourceSpec{
+						Source: cdiv1beta1.DataSourceSource{
+							PVC: &cdiv1beta1.DataVolumeSourcePVC{Name: name + "-previous", Namespace: namespace},
+						},
+					},
+				}, metav1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = kubeClient.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), &corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: name + "-previous", Namespace: namespace},
+				}, metav1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+
+				cdiClient.PrependReactor("create", "datavolumes", succeedDataVolumes(namespace))
+			})
+
+			It("halts without force", func() {
+				action := step.Run(context.Background(), state)
+				Expect(action).To(Equal(multistep.ActionHalt))
+				Expect(created).To(BeEmpty())
+			})
+
+			It("switches the DataSource to a new volume with force", func() {
+				step.Config.Force = true
+
+				cdiClient.PrependReactor("delete", "datasources", func(action testing.Action) (bool, runtime.Object, error) {
+					Fail("the existing DataSource must not be deleted")
+					return true, nil, nil
+				})
+
+				action := step.Run(context.Background(), state)
+				Expect(action).To(Equal(multistep.ActionContinue))
+				Expect(created).To(HaveKey(name + "-x7k2p"))
+
+				ds, err := cdiClient.CdiV1beta1().DataSources(namespace).Get(context.Background(), name, metav1.GetOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ds.Spec.Source.PVC.Name).To(Equal(name + "-x7k2p"))
+				Expect(ds.Labels).To(HaveKeyWithValue("instancetype.kubevirt.io/default-instancetype", "cx1.large"))
+
+				_, err = kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name+"-previous", metav1.GetOptions{})
+				Expect(err).To(HaveOccurred())
+
+				// The new volume is published, and no longer deleted if the build fails afterwards.
+				state.Put(multistep.StateHalted, true)
+				(&iso.StepCreateBuildLease{Config: step.Config, Client: kubeClient}).Cleanup(state)
+
+				_, err = kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name+"-x7k2p", metav1.GetOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("switches the DataSource to a new volume with -force", func() {
+				step.Config.PackerForce = true
+
+				action := step.Run(context.Background(), state)
+				Expect(action).To(Equal(multistep.ActionContinue))
+
+				ds, err := cdiClient.CdiV1beta1().DataSources(namespace).Get(context.Background(), name, metav1.GetOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ds.Spec.Source.PVC.Name).To(Equal(name + "-x7k2p"))
+			})
+		})
 	})
 })
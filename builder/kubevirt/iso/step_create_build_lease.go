@@ -0,0 +1,115 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+)
+
+// StepCreateBuildLease creates the ConfigMap owning the temporary resources of the build, so that
+// they are garbage collected along with it even if the build is interrupted. Stale leases of
+// previous builds are deleted first when cleanup_stale_builds is set. Being the first step to
+// create resources, its cleanup deletes all the resources tracked by the following steps.
+type StepCreateBuildLease struct {
+	Config Config
+	Client kubernetes.Interface
+}
+
+func (s *StepCreateBuildLease) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.buildNamespace()
+	name := s.Config.buildName() + "-lease"
+
+	if s.Config.CleanupStaleBuilds {
+		if err := s.deleteStaleLeases(ctx, ui); err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	ttl := s.Config.BuildLeaseTTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+
+	ui.Sayf("Creating a new build lease (%s/%s)...", namespace, name)
+
+	lease, err := s.Client.CoreV1().ConfigMaps(namespace).Create(ctx, buildLease(name, ttl), metav1.CreateOptions{})
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("build_lease", lease)
+	return multistep.ActionContinue
+}
+
+// Cleanup deletes the resources created by the build, then the build lease,
+// unless they are kept on success or failure.
+func (s *StepCreateBuildLease) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.buildNamespace()
+
+	kept := deleteTrackedResources(state, s.Config)
+
+	lease, ok := state.Get("build_lease").(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	if kept {
+		ui.Sayf("Keeping build lease (%s/%s) along with the build resources.", namespace, lease.Name)
+		return
+	}
+
+	ui.Sayf("Deleting build lease (%s/%s)...", namespace, lease.Name)
+
+	_ = s.Client.CoreV1().ConfigMaps(namespace).Delete(context.Background(), lease.Name, metav1.DeleteOptions{
+		PropagationPolicy: ptr.To(metav1.DeletePropagationBackground),
+	})
+}
+
+// deleteStaleLeases deletes the build leases whose TTL has expired, which garbage collects
+// the resources left behind by interrupted builds.
+func (s *StepCreateBuildLease) deleteStaleLeases(ctx context.Context, ui packer.Ui) error {
+	namespace := s.Config.buildNamespace()
+
+	leases, err := s.Client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: buildLeaseLabel + "=true",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, lease := range leases.Items {
+		ttl, err := time.ParseDuration(lease.Annotations[buildLeaseTTLAnnotation])
+		if err != nil {
+			ui.Sayf("Skipping build lease (%s/%s) with an invalid TTL: %s", namespace, lease.Name, err)
+			continue
+		}
+
+		if time.Since(lease.CreationTimestamp.Time) < ttl {
+			continue
+		}
+
+		ui.Sayf("Deleting stale build lease (%s/%s)...", namespace, lease.Name)
+
+		err = s.Client.CoreV1().ConfigMaps(namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{
+			PropagationPolicy: ptr.To(metav1.DeletePropagationBackground),
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
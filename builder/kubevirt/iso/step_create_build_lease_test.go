@@ -0,0 +1,146 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakek8sclient "k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("StepCreateBuildLease", func() {
+	const (
+		namespace = "test-ns"
+		name      = "test-vm"
+	)
+
+	var (
+		state      *multistep.BasicStateBag
+		step       *iso.StepCreateBuildLease
+		kubeClient *fakek8sclient.Clientset
+	)
+
+	// createLease creates a build lease of a previous build, created at the given time.
+	createLease := func(leaseName, ttl string, created time.Time) {
+		_, err := kubeClient.CoreV1().ConfigMaps(namespace).Create(context.Background(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              leaseName,
+				Namespace:         namespace,
+				CreationTimestamp: metav1.NewTime(created),
+				Labels:            map[string]string{"packer.io/build-lease": "true"},
+				Annotations:       map[string]string{"packer.io/build-lease-ttl": ttl},
+			},
+		}, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      io.Discard,
+			ErrorWriter: io.Discard,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		kubeClient = fakek8sclient.NewSimpleClientset()
+
+		step = &iso.StepCreateBuildLease{
+			Config: iso.Config{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Client: kubeClient,
+		}
+	})
+
+	Context("Run", func() {
+		It("creates the build lease with the default TTL", func() {
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			lease, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name+"-lease", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lease.Labels).To(HaveKeyWithValue("packer.io/build-lease", "true"))
+			Expect(lease.Annotations).To(HaveKeyWithValue("packer.io/build-lease-ttl", "24h0m0s"))
+			Expect(state.Get("build_lease")).To(HaveField("Name", name+"-lease"))
+		})
+
+		It("deletes the stale build leases when cleanup_stale_builds is set", func() {
+			step.Config.CleanupStaleBuilds = true
+			step.Config.BuildLeaseTTL = time.Hour
+
+			createLease("stale-lease", "1h0m0s", time.Now().Add(-2*time.Hour))
+			createLease("active-lease", "6h0m0s", time.Now().Add(-2*time.Hour))
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: namespace},
+			}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), "stale-lease", metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+			_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), "active-lease", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), "other", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			lease, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name+"-lease", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lease.Annotations).To(HaveKeyWithValue("packer.io/build-lease-ttl", "1h0m0s"))
+		})
+
+		It("keeps the stale build leases by default", func() {
+			createLease("stale-lease", "1h0m0s", time.Now().Add(-2*time.Hour))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), "stale-lease", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("halts when the build lease already exists", func() {
+			createLease(name+"-lease", "24h0m0s", time.Now())
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+	})
+
+	Context("Cleanup", func() {
+		It("deletes the build lease", func() {
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+
+			step.Cleanup(state)
+
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name+"-lease", metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("keeps the build lease along with the VM when KeepVM is true", func() {
+			step.Config.KeepVM = true
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+
+			step.Cleanup(state)
+
+			_, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name+"-lease", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
@@ -10,6 +10,7 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	ptr "k8s.io/utils/ptr"
@@ -24,41 +25,68 @@ type StepCreateVirtualMachine struct {
 
 func (s *StepCreateVirtualMachine) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	name := s.Config.Name
-	namespace := s.Config.Namespace
-	isoVolumeName := s.Config.IsoVolumeName
-	diskSize := s.Config.DiskSize
-	instanceTypeName := s.Config.InstanceType
-	instanceTypeKind := s.Config.InstanceTypeKind
-	preferenceName := s.Config.Preference
-	preferenceKind := s.Config.PreferenceKind
-	osType := s.Config.OperatingSystemType
-	networks := s.Config.Networks
-
-	if osType == "" || (osType != "linux" && osType != "windows") {
-		ui.Errorf("OS type of '%s' is not supported, set 'linux' or 'windows'.", osType)
+	name := s.Config.buildName()
+	namespace := s.Config.buildNamespace()
+
+	profile, err := s.Config.osProfile()
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	mediaVolumeName, _ := state.Get("media_files_volume_name").(string)
+
+	config := s.Config
+	if profile.VirtioDrivers && config.VirtioContainerImage == "auto" && !config.DisableVirtioDrivers {
+		image, err := VirtioContainerImage(ctx, s.Client)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		ui.Sayf("Using the VirtIO drivers of the installed KubeVirt (%s)...", image)
+		config.VirtioContainerImage = image
+	}
+
+	virtualMachine, err := virtualMachine(config, mediaVolumeName)
+	if err != nil {
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	virtualMachine := virtualMachine(
-		name,
-		isoVolumeName,
-		diskSize,
-		instanceTypeName,
-		preferenceName,
-		instanceTypeKind,
-		preferenceKind,
-		osType,
-		networks)
+	lease, _ := state.Get("build_lease").(*corev1.ConfigMap)
+	virtualMachine.OwnerReferences = ownerReferences(lease)
 
 	ui.Sayf("Creating a new temporary VirtualMachine (%s/%s)...", namespace, name)
 
-	_, err := s.Client.VirtualMachine(namespace).Create(ctx, virtualMachine, metav1.CreateOptions{})
+	_, err = s.Client.VirtualMachine(namespace).Create(ctx, virtualMachine, metav1.CreateOptions{})
 	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
+	// The disks are tracked before the VM, so that they are deleted once the VM is gone.
+	for _, dv := range virtualMachine.Spec.DataVolumeTemplates {
+		dvName := dv.Name
+		trackResource(state, trackedResource{
+			Kind:      "DataVolume",
+			Namespace: namespace,
+			Name:      dvName,
+			Delete: func(ctx context.Context) error {
+				return s.Client.CdiClient().CdiV1beta1().DataVolumes(namespace).Delete(ctx, dvName, metav1.DeleteOptions{})
+			},
+		})
+	}
+	trackResource(state, trackedResource{
+		Kind:      "VirtualMachine",
+		Namespace: namespace,
+		Name:      name,
+		Delete: func(ctx context.Context) error {
+			return s.Client.VirtualMachine(namespace).Delete(ctx, name, metav1.DeleteOptions{
+				GracePeriodSeconds: ptr.To(int64(0)),
+			})
+		},
+	})
+
 	if err := s.waitUntilVirtualMachineReady(ctx); err != nil {
 		return multistep.ActionHalt
 	}
@@ -66,26 +94,12 @@ func (s *StepCreateVirtualMachine) Run(ctx context.Context, state multistep.Stat
 }
 
 func (s *StepCreateVirtualMachine) Cleanup(state multistep.StateBag) {
-	ui := state.Get("ui").(packer.Ui)
-	name := s.Config.Name
-	namespace := s.Config.Namespace
-	keepVM := s.Config.KeepVM
-
-	if keepVM {
-		ui.Sayf("Keeping VirtualMachine (%s/%s).", namespace, name)
-		return
-	}
-
-	ui.Sayf("Deleting VirtualMachine (%s/%s)...", namespace, name)
-
-	_ = s.Client.VirtualMachine(namespace).Delete(context.Background(), name, metav1.DeleteOptions{
-		GracePeriodSeconds: ptr.To(int64(0)),
-	})
+	// Left blank intentionally
 }
 
 func (s *StepCreateVirtualMachine) waitUntilVirtualMachineReady(ctx context.Context) error {
-	name := s.Config.Name
-	namespace := s.Config.Namespace
+	name := s.Config.buildName()
+	namespace := s.Config.buildNamespace()
 	pollInterval := 5 * time.Second
 	pollTimeout := 3600 * time.Second
 	poller := func(ctx context.Context) (bool, error) {
@@ -0,0 +1,138 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	templatev1 "github.com/openshift/api/template/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/client-go/kubecli"
+
+	"sigs.k8s.io/yaml"
+)
+
+type StepCreateVirtualMachineTemplate struct {
+	Config Config
+	Client kubecli.KubevirtClient
+}
+
+func (s *StepCreateVirtualMachineTemplate) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.outputNamespace()
+	template := s.Config.VirtualMachineTemplate
+	name := s.Config.templateName()
+
+	// The VMs are created with the size of the shrunk root disk.
+	config := s.Config
+	if size, ok := state.Get("output_disk_size").(string); ok {
+		config.OutputDiskSize = size
+	}
+
+	var manifest runtime.Object
+	if template.Kind == "Template" {
+		vm, err := templateVirtualMachine(config, "${NAME}")
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		manifest, err = openshiftTemplate(name, vm)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	} else {
+		vm, err := templateVirtualMachine(config, name)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		manifest = vm
+	}
+
+	if template.Path != "" {
+		ui.Sayf("Writing the VirtualMachine manifest to %s...", template.Path)
+
+		data, err := yaml.Marshal(manifest)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		if err := os.WriteFile(template.Path, data, 0644); err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		state.Put("vm_template_file", template.Path)
+	}
+
+	if template.Create {
+		ui.Sayf("Creating the VirtualMachine manifest (%s/%s)...", namespace, name)
+
+		if err := s.create(ctx, manifest); err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *StepCreateVirtualMachineTemplate) Cleanup(state multistep.StateBag) {
+	// Left blank intentionally
+}
+
+// create creates the manifest in the output namespace. An existing VirtualMachine or Template
+// is replaced with force.
+func (s *StepCreateVirtualMachineTemplate) create(ctx context.Context, manifest runtime.Object) error {
+	namespace := s.Config.outputNamespace()
+
+	switch obj := manifest.(type) {
+	case *v1.VirtualMachine:
+		client := s.Client.VirtualMachine(namespace)
+		_, err := client.Create(ctx, obj, metav1.CreateOptions{})
+		if !errors.IsAlreadyExists(err) || !s.Config.force() {
+			return err
+		}
+
+		existing, err := client.Get(ctx, obj.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		obj.ResourceVersion = existing.ResourceVersion
+		_, err = client.Update(ctx, obj, metav1.UpdateOptions{})
+		return err
+	default:
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return err
+		}
+		template := &unstructured.Unstructured{Object: content}
+
+		resource := templatev1.GroupVersion.WithResource("templates")
+		client := s.Client.DynamicClient().Resource(resource).Namespace(namespace)
+		_, err = client.Create(ctx, template, metav1.CreateOptions{})
+		if !errors.IsAlreadyExists(err) || !s.Config.force() {
+			return err
+		}
+
+		existing, err := client.Get(ctx, template.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		template.SetResourceVersion(existing.GetResourceVersion())
+		_, err = client.Update(ctx, template, metav1.UpdateOptions{})
+		return err
+	}
+}
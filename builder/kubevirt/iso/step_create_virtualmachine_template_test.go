@@ -0,0 +1,200 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	templatev1 "github.com/openshift/api/template/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/client-go/kubecli"
+	kubevirtfake "kubevirt.io/client-go/kubevirt/fake"
+
+	"sigs.k8s.io/yaml"
+)
+
+var _ = Describe("StepCreateVirtualMachineTemplate", func() {
+	const (
+		namespace = "test-ns"
+		name      = "fedora-image"
+	)
+
+	var (
+		ctrl       *gomock.Controller
+		vmClient   *kubevirtfake.Clientset
+		virtClient kubecli.KubevirtClient
+		state      *multistep.BasicStateBag
+		step       *iso.StepCreateVirtualMachineTemplate
+		dir        string
+	)
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+
+		uiErr := &strings.Builder{}
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      io.Discard,
+			ErrorWriter: uiErr,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		vmClient = kubevirtfake.NewSimpleClientset()
+
+		kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
+		kubecli.MockKubevirtClientInstance = kubecli.NewMockKubevirtClient(ctrl)
+		kubecli.MockKubevirtClientInstance.EXPECT().
+			VirtualMachine(gomock.Any()).
+			DoAndReturn(func(ns string) kubecli.VirtualMachineInterface {
+				return vmClient.KubevirtV1().VirtualMachines(ns)
+			}).AnyTimes()
+
+		virtClient, _ = kubecli.GetKubevirtClientFromClientConfig(nil)
+		dir = GinkgoT().TempDir()
+
+		step = &iso.StepCreateVirtualMachineTemplate{
+			Config: iso.Config{
+				Name:         name,
+				Namespace:    namespace,
+				DiskSize:     "10Gi",
+				InstanceType: "u1.medium",
+				Preference:   "fedora",
+				Disks: []iso.Disk{
+					{Name: "data", Output: true, VolumeSource: iso.VolumeSource{Blank: &iso.BlankVolume{Size: "5Gi"}}},
+				},
+				VirtualMachineTemplate: &iso.VirtualMachineTemplate{
+					Path: filepath.Join(dir, "vm.yaml"),
+				},
+			},
+			Client: virtClient,
+		}
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	Context("Run", func() {
+		It("writes a VirtualMachine manifest booting from the published volumes", func() {
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(state.Get("vm_template_file")).To(Equal(filepath.Join(dir, "vm.yaml")))
+
+			data, err := os.ReadFile(filepath.Join(dir, "vm.yaml"))
+			Expect(err).NotTo(HaveOccurred())
+
+			vm := &v1.VirtualMachine{}
+			Expect(yaml.Unmarshal(data, vm)).To(Succeed())
+			Expect(vm.Name).To(Equal(name))
+			Expect(*vm.Spec.RunStrategy).To(Equal(v1.RunStrategyHalted))
+			Expect(vm.Spec.Instancetype.Name).To(Equal("u1.medium"))
+			Expect(vm.Spec.Preference.Name).To(Equal("fedora"))
+			Expect(vm.Spec.DataVolumeTemplates).To(HaveLen(2))
+			Expect(vm.Spec.DataVolumeTemplates[0].Spec.SourceRef.Name).To(Equal(name))
+			Expect(vm.Spec.DataVolumeTemplates[1].Spec.SourceRef.Name).To(Equal(name + "-data"))
+			Expect(vm.Spec.Template.Spec.Volumes).To(HaveLen(2))
+		})
+
+		It("sizes the root disk after the shrunk output disk", func() {
+			step.Config.OutputDiskSize = "minimal"
+			state.Put("output_disk_size", "2064Mi")
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			data, err := os.ReadFile(filepath.Join(dir, "vm.yaml"))
+			Expect(err).NotTo(HaveOccurred())
+
+			vm := &v1.VirtualMachine{}
+			Expect(yaml.Unmarshal(data, vm)).To(Succeed())
+			Expect(vm.Spec.DataVolumeTemplates[0].Spec.Storage.Resources.Requests.Storage().String()).To(Equal("2064Mi"))
+		})
+
+		It("writes an OpenShift Template with a NAME parameter", func() {
+			step.Config.VirtualMachineTemplate.Kind = "Template"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			data, err := os.ReadFile(filepath.Join(dir, "vm.yaml"))
+			Expect(err).NotTo(HaveOccurred())
+
+			template := &templatev1.Template{}
+			Expect(yaml.Unmarshal(data, template)).To(Succeed())
+			Expect(template.Name).To(Equal(name))
+			Expect(template.Parameters).To(HaveLen(1))
+			Expect(template.Parameters[0].Name).To(Equal("NAME"))
+			Expect(template.Objects).To(HaveLen(1))
+			Expect(string(template.Objects[0].Raw)).To(ContainSubstring(`"name":"${NAME}"`))
+		})
+
+		It("creates a halted VirtualMachine in the cluster", func() {
+			step.Config.VirtualMachineTemplate = &iso.VirtualMachineTemplate{
+				Name:   "fedora-vm",
+				Create: true,
+			}
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(state.Get("vm_template_file")).To(BeNil())
+
+			vm, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), "fedora-vm", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*vm.Spec.RunStrategy).To(Equal(v1.RunStrategyHalted))
+		})
+
+		Context("when the VirtualMachine already exists", func() {
+			BeforeEach(func() {
+				step.Config.VirtualMachineTemplate = &iso.VirtualMachineTemplate{
+					Name:   "fedora-vm",
+					Create: true,
+				}
+				_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(), &v1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{Name: "fedora-vm", Namespace: namespace},
+				}, metav1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("halts without force", func() {
+				action := step.Run(context.Background(), state)
+				Expect(action).To(Equal(multistep.ActionHalt))
+			})
+
+			It("replaces it with force", func() {
+				step.Config.Force = true
+
+				action := step.Run(context.Background(), state)
+				Expect(action).To(Equal(multistep.ActionContinue))
+
+				vm, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), "fedora-vm", metav1.GetOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*vm.Spec.RunStrategy).To(Equal(v1.RunStrategyHalted))
+				Expect(vm.Spec.Instancetype.Name).To(Equal("u1.medium"))
+			})
+		})
+
+		It("halts when the manifest cannot be written", func() {
+			step.Config.VirtualMachineTemplate.Path = filepath.Join(dir, "missing", "vm.yaml")
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+	})
+})
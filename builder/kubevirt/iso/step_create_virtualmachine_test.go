@@ -17,6 +17,7 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	fakek8sclient "k8s.io/client-go/kubernetes/fake"
@@ -25,6 +26,7 @@ import (
 	fakecdiclient "kubevirt.io/client-go/containerizeddataimporter/fake"
 	"kubevirt.io/client-go/kubecli"
 	kubevirtfake "kubevirt.io/client-go/kubevirt/fake"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 )
 
 var _ = Describe("StepCreateVirtualMachine", func() {
@@ -67,6 +69,11 @@ var _ = Describe("StepCreateVirtualMachine", func() {
 			DoAndReturn(func(ns string) kubecli.VirtualMachineInterface {
 				return vmClient.KubevirtV1().VirtualMachines(ns)
 			}).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().
+			KubeVirt(gomock.Any()).
+			DoAndReturn(func(ns string) kubecli.KubeVirtInterface {
+				return vmClient.KubevirtV1().KubeVirts(ns)
+			}).AnyTimes()
 		kubecli.MockKubevirtClientInstance.EXPECT().CdiClient().Return(cdiClient).AnyTimes()
 
 		virtClient, _ = kubecli.GetKubevirtClientFromClientConfig(nil)
@@ -99,6 +106,12 @@ var _ = Describe("StepCreateVirtualMachine", func() {
 			Expect(action).To(Equal(multistep.ActionHalt))
 		})
 
+		It("halts when the disk size is invalid", func() {
+			step.Config.DiskSize = "64GB"
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+
 		It("continues when VM is created and becomes Ready", func() {
 			// Let Run create the VM, then mark it Ready
 			ctx, cancel := context.WithCancel(context.Background())
@@ -117,6 +130,407 @@ var _ = Describe("StepCreateVirtualMachine", func() {
 			Expect(action).To(Equal(multistep.ActionContinue))
 		})
 
+		It("creates the VM with the configured scheduling constraints", func() {
+			step.Config.NodeSelector = map[string]string{"node-role.kubernetes.io/builder": ""}
+			step.Config.Tolerations = []iso.Toleration{
+				{Key: "dedicated", Operator: "Equal", Value: "builds", Effect: "NoSchedule"},
+			}
+			step.Config.Affinity = `{"nodeAffinity": {"requiredDuringSchedulingIgnoredDuringExecution": {"nodeSelectorTerms": [{"matchExpressions": [{"key": "zone", "operator": "In", "values": ["a"]}]}]}}}`
+			step.Config.PriorityClassName = "builds"
+			step.Config.EvictionStrategy = "External"
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			spec := created.Spec.Template.Spec
+			Expect(spec.NodeSelector).To(HaveKey("node-role.kubernetes.io/builder"))
+			Expect(spec.Tolerations).To(ConsistOf(corev1.Toleration{
+				Key:      "dedicated",
+				Operator: corev1.TolerationOpEqual,
+				Value:    "builds",
+				Effect:   corev1.TaintEffectNoSchedule,
+			}))
+			Expect(spec.Affinity.NodeAffinity).NotTo(BeNil())
+			Expect(spec.PriorityClassName).To(Equal("builds"))
+			Expect(*spec.EvictionStrategy).To(Equal(v1.EvictionStrategyExternal))
+		})
+
+		It("names the VM and its resources after the build", func() {
+			step.Config = step.Config.WithBuildID("x7k2p")
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			Expect(created.Name).To(Equal(name + "-x7k2p"))
+			Expect(created.OwnerReferences).To(BeEmpty())
+			Expect(created.Spec.DataVolumeTemplates[0].Name).To(Equal(name + "-x7k2p-rootdisk"))
+			Expect(created.Spec.Template.Spec.Volumes).To(ContainElement(And(
+				HaveField("Name", "oemdrv"),
+				HaveField("VolumeSource.ConfigMap.Name", name+"-x7k2p"),
+			)))
+		})
+
+		It("sets the build lease as the owner of the VM", func() {
+			state.Put("build_lease", &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name + "-lease", UID: "lease-uid"},
+			})
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(created.OwnerReferences).To(ConsistOf(HaveField("UID", BeEquivalentTo("lease-uid"))))
+		})
+
+		It("creates the VM with explicit sizing when no instance type is set", func() {
+			step.Config.InstanceType = ""
+			step.Config.Preference = ""
+			step.Config.CPU = 4
+			step.Config.Memory = "8Gi"
+			step.Config.MachineType = "q35"
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			Expect(created.Spec.Instancetype).To(BeNil())
+			Expect(created.Spec.Preference).To(BeNil())
+
+			domain := created.Spec.Template.Spec.Domain
+			Expect(domain.CPU.Cores).To(Equal(uint32(4)))
+			Expect(domain.Memory.Guest.String()).To(Equal("8Gi"))
+			Expect(domain.Machine.Type).To(Equal("q35"))
+		})
+
+		It("creates the VM with additional disks", func() {
+			step.Config.Disks = []iso.Disk{
+				{
+					Name:         "scratch",
+					Bus:          "virtio",
+					Serial:       "SCRATCH",
+					VolumeSource: iso.VolumeSource{Blank: &iso.BlankVolume{Size: "20Gi"}},
+				},
+				{
+					Name:      "repo",
+					Type:      "cdrom",
+					Bus:       "sata",
+					BootOrder: 4,
+					VolumeSource: iso.VolumeSource{
+						PersistentVolumeClaim: &iso.PersistentVolumeClaimVolume{ClaimName: "offline-repo", ReadOnly: true},
+					},
+				},
+				{
+					Name:         "drivers",
+					Type:         "cdrom",
+					VolumeSource: iso.VolumeSource{ContainerDisk: &iso.ContainerDiskVolume{Image: "registry.local/drivers:latest"}},
+				},
+			}
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			Expect(created.Spec.DataVolumeTemplates).To(HaveLen(2))
+			Expect(created.Spec.DataVolumeTemplates[1].Name).To(Equal(name + "-scratchdisk"))
+
+			disks := map[string]v1.Disk{}
+			for _, d := range created.Spec.Template.Spec.Domain.Devices.Disks {
+				disks[d.Name] = d
+			}
+			Expect(disks["scratch"].Disk.Bus).To(Equal(v1.DiskBus("virtio")))
+			Expect(disks["scratch"].Serial).To(Equal("SCRATCH"))
+			Expect(disks["repo"].CDRom).NotTo(BeNil())
+			Expect(*disks["repo"].BootOrder).To(Equal(uint(4)))
+			Expect(disks["drivers"].CDRom).NotTo(BeNil())
+
+			volumes := map[string]v1.Volume{}
+			for _, v := range created.Spec.Template.Spec.Volumes {
+				volumes[v.Name] = v
+			}
+			Expect(volumes["scratch"].DataVolume.Name).To(Equal(name + "-scratchdisk"))
+			Expect(volumes["repo"].PersistentVolumeClaim.ClaimName).To(Equal("offline-repo"))
+			Expect(volumes["repo"].PersistentVolumeClaim.ReadOnly).To(BeTrue())
+			Expect(volumes["drivers"].ContainerDisk.Image).To(Equal("registry.local/drivers:latest"))
+		})
+
+		It("attaches media files from a Secret when media_files_secret is set", func() {
+			step.Config.OperatingSystemType = "windows"
+			step.Config.MediaFilesSecret = true
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			var sysprep *v1.SysprepSource
+			for _, v := range created.Spec.Template.Spec.Volumes {
+				if v.Name == "sysprep" {
+					sysprep = v.Sysprep
+				}
+			}
+			Expect(sysprep).NotTo(BeNil())
+			Expect(sysprep.ConfigMap).To(BeNil())
+			Expect(sysprep.Secret.Name).To(Equal(name))
+		})
+
+		It("attaches media files from the uploaded DataVolume", func() {
+			state.Put("media_files_volume_name", name+"-mediadisk")
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			var oemdrv v1.Volume
+			for _, v := range created.Spec.Template.Spec.Volumes {
+				if v.Name == "oemdrv" {
+					oemdrv = v
+				}
+			}
+			Expect(oemdrv.ConfigMap).To(BeNil())
+			Expect(oemdrv.DataVolume.Name).To(Equal(name + "-mediadisk"))
+		})
+
+		It("attaches cloud-init data and labels the media volume", func() {
+			step.Config.MediaVolumeLabel = "cidata"
+			step.Config.CloudInit = &iso.CloudInit{
+				Type:        "ConfigDrive",
+				UserData:    "#cloud-config",
+				NetworkData: "version: 2",
+				MetaData: &iso.CloudInitMetaData{
+					LocalHostname:       "fedora-build",
+					PublicKeysSecretRef: "build-keys",
+				},
+			}
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			volumes := map[string]v1.Volume{}
+			for _, v := range created.Spec.Template.Spec.Volumes {
+				volumes[v.Name] = v
+			}
+			Expect(volumes["oemdrv"].ConfigMap.VolumeLabel).To(Equal("cidata"))
+			Expect(volumes["cloudinit"].CloudInitNoCloud).To(BeNil())
+			Expect(volumes["cloudinit"].CloudInitConfigDrive.UserData).To(Equal("#cloud-config"))
+			Expect(volumes["cloudinit"].CloudInitConfigDrive.NetworkData).To(Equal("version: 2"))
+			Expect(created.Spec.Template.Spec.Domain.Devices.Disks).To(ContainElement(HaveField("Name", "cloudinit")))
+			Expect(created.Spec.Template.Spec.Hostname).To(Equal("fedora-build"))
+			Expect(created.Spec.Template.Spec.AccessCredentials).To(ConsistOf(HaveField("SSHPublicKey.Source.Secret.SecretName", "build-keys")))
+			Expect(created.Spec.Template.Spec.AccessCredentials[0].SSHPublicKey.PropagationMethod.ConfigDrive).NotTo(BeNil())
+		})
+
+		It("clones the ISO into the build namespace", func() {
+			step.Config.IsoNamespace = "os-media"
+			step.Config.BuildNamespace = "packer-builds"
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			_, err := vmClient.KubevirtV1().VirtualMachines("packer-builds").Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(created.Spec.Template.Spec.Volumes).To(ContainElement(And(
+				HaveField("Name", "cdrom"),
+				HaveField("VolumeSource.DataVolume.Name", name+"-isodisk"),
+			)))
+			Expect(created.Spec.DataVolumeTemplates).To(ContainElement(And(
+				HaveField("Name", name+"-isodisk"),
+				HaveField("Spec.Source.PVC.Name", "iso-vol"),
+				HaveField("Spec.Source.PVC.Namespace", "os-media"),
+			)))
+		})
+
+		It("creates a CoreOS VM with the Ignition config", func() {
+			step.Config.OperatingSystemType = "coreos"
+			step.Config.Ignition = &iso.Ignition{Config: `{"ignition":{"version":"3.4.0"}}`}
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			Expect(created.Spec.Template.ObjectMeta.Annotations).To(HaveKeyWithValue(v1.IgnitionAnnotation, `{"ignition":{"version":"3.4.0"}}`))
+			Expect(created.Spec.Template.Spec.Volumes).To(HaveLen(2))
+			Expect(created.Spec.Template.Spec.Volumes).NotTo(ContainElement(HaveField("Name", "oemdrv")))
+		})
+
+		It("attaches the VirtIO drivers of the installed KubeVirt", func() {
+			step.Config.OperatingSystemType = "windows"
+			step.Config.VirtioContainerImage = "auto"
+
+			_, err := vmClient.KubevirtV1().KubeVirts("kubevirt").Create(context.Background(), &v1.KubeVirt{
+				ObjectMeta: metav1.ObjectMeta{Name: "kubevirt", Namespace: "kubevirt"},
+				Status: v1.KubeVirtStatus{
+					ObservedKubeVirtRegistry: "registry.example.com/kubevirt",
+					ObservedKubeVirtVersion:  "v1.6.0",
+				},
+			}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			var virtio v1.Volume
+			for _, v := range created.Spec.Template.Spec.Volumes {
+				if v.Name == "virtiocontainerdisk" {
+					virtio = v
+				}
+			}
+			Expect(virtio.ContainerDisk.Image).To(Equal("registry.example.com/kubevirt/virtio-container-disk:v1.6.0"))
+		})
+
+		It("halts when the VirtIO drivers image cannot be detected", func() {
+			step.Config.OperatingSystemType = "windows"
+			step.Config.VirtioContainerImage = "auto"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+
+		It("does not attach the VirtIO drivers when disabled", func() {
+			step.Config.OperatingSystemType = "windows"
+			step.Config.DisableVirtioDrivers = true
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			Expect(created.Spec.Template.Spec.Volumes).NotTo(ContainElement(HaveField("Name", "virtiocontainerdisk")))
+			Expect(created.Spec.Template.Spec.Domain.Devices.Disks).NotTo(ContainElement(HaveField("Name", "virtiocontainerdisk")))
+		})
+
+		It("labels the media CD-ROM of the ubuntu-autoinstall profile as cidata", func() {
+			step.Config.OperatingSystemType = "ubuntu-autoinstall"
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			var oemdrv v1.Volume
+			for _, v := range created.Spec.Template.Spec.Volumes {
+				if v.Name == "oemdrv" {
+					oemdrv = v
+				}
+			}
+			Expect(oemdrv.ConfigMap.VolumeLabel).To(Equal("cidata"))
+		})
+
+		It("creates the VM with a custom OS profile", func() {
+			step.Config.OperatingSystemType = "custom"
+			step.Config.OSProfile = &iso.OSProfile{
+				CDRomBus: "scsi",
+				DiskBus:  "sata",
+				Media:    "none",
+			}
+
+			var created *v1.VirtualMachine
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				created.Status.Ready = true
+				return false, created, nil
+			})
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			disks := created.Spec.Template.Spec.Domain.Devices.Disks
+			Expect(disks).To(HaveLen(2))
+			Expect(disks[0].CDRom.Bus).To(Equal(v1.DiskBus("scsi")))
+			Expect(disks[1].Disk.Bus).To(Equal(v1.DiskBus("sata")))
+		})
+
+		It("halts when the custom OS profile is missing", func() {
+			step.Config.OperatingSystemType = "custom"
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+
+		It("halts when affinity cannot be decoded", func() {
+			step.Config.Affinity = "nodeAffinity: ["
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+
 		It("halts when VM creation fails", func() {
 			// Inject error into fake client
 			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
@@ -148,26 +562,86 @@ var _ = Describe("StepCreateVirtualMachine", func() {
 	})
 
 	Context("Cleanup", func() {
+		var cleanup *iso.StepCreateBuildLease
+
+		BeforeEach(func() {
+			vmClient.Fake.PrependReactor("create", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				vm := action.(k8stesting.CreateAction).GetObject().(*v1.VirtualMachine)
+				vm.Status.Ready = true
+				return false, vm, nil
+			})
+
+			// The resources tracked by the step are deleted by the build lease step.
+			cleanup = &iso.StepCreateBuildLease{Config: step.Config, Client: kubeClient}
+		})
+
 		It("keeps VM when KeepVM is true", func() {
-			step.Config.KeepVM = true
-			step.Cleanup(state) // should not panic
+			cleanup.Config.KeepVM = true
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+
+			step.Cleanup(state)
+			cleanup.Cleanup(state)
+
+			_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
 		})
 
 		It("deletes VM when KeepVM is false", func() {
-			_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(),
-				&v1.VirtualMachine{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      name,
-						Namespace: namespace,
-					},
-				},
-				metav1.CreateOptions{})
-			Expect(err).NotTo(HaveOccurred())
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
 
 			step.Cleanup(state)
+			cleanup.Cleanup(state)
 
-			_, err = vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
 			Expect(err).To(HaveOccurred()) // deleted
 		})
+
+		It("deletes the VM before its root disk", func() {
+			_, err := cdiClient.CdiV1beta1().DataVolumes(namespace).Create(context.Background(), &cdiv1beta1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: name + "-rootdisk", Namespace: namespace},
+			}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+
+			var deleted []string
+			vmClient.Fake.PrependReactor("delete", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				deleted = append(deleted, action.(k8stesting.DeleteAction).GetName())
+				return false, nil, nil
+			})
+			cdiClient.Fake.PrependReactor("delete", "datavolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				deleted = append(deleted, action.(k8stesting.DeleteAction).GetName())
+				return false, nil, nil
+			})
+
+			step.Cleanup(state)
+			cleanup.Cleanup(state)
+
+			Expect(deleted).To(Equal([]string{name, name + "-rootdisk"}))
+			_, err = cdiClient.CdiV1beta1().DataVolumes(namespace).Get(context.Background(), name+"-rootdisk", metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("keeps VM when the build succeeds with keep_on_success", func() {
+			cleanup.Config.KeepOnSuccess = true
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+
+			step.Cleanup(state)
+			cleanup.Cleanup(state)
+
+			_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("deletes VM when the build fails with keep_on_success", func() {
+			cleanup.Config.KeepOnSuccess = true
+			Expect(step.Run(context.Background(), state)).To(Equal(multistep.ActionContinue))
+			state.Put(multistep.StateCancelled, true)
+
+			step.Cleanup(state)
+			cleanup.Cleanup(state)
+
+			_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
 	})
 })
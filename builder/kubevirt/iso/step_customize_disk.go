@@ -0,0 +1,56 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type StepCustomizeDisk struct {
+	Config Config
+	Client kubernetes.Interface
+}
+
+func (s *StepCustomizeDisk) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.buildNamespace()
+	name := s.Config.buildName() + "-customize"
+
+	claim, err := s.Client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, diskVolumeName(s.Config.buildName(), "root"), metav1.GetOptions{})
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	pod, err := customizePod(s.Config, name, claim.Spec.VolumeMode)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Sayf("Customizing the root disk in a new Pod (%s/%s)...", namespace, name)
+
+	pod, err = runPod(ctx, state, s.Client, namespace, pod)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if pod.Status.Phase != corev1.PodSucceeded {
+		ui.Errorf("Customize Pod (%s/%s) failed, see the logs above.", namespace, name)
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *StepCustomizeDisk) Cleanup(state multistep.StateBag) {
+	// Left blank intentionally
+}
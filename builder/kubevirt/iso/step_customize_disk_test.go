@@ -0,0 +1,157 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakek8sclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var _ = Describe("StepCustomizeDisk", func() {
+	const (
+		namespace = "test-ns"
+		name      = "test-vm"
+	)
+
+	var (
+		state      *multistep.BasicStateBag
+		step       *iso.StepCustomizeDisk
+		kubeClient *fakek8sclient.Clientset
+		uiOut      *strings.Builder
+	)
+
+	// completePod simulates a Pod running to completion with the given phase.
+	completePod := func(phase corev1.PodPhase) k8stesting.ReactionFunc {
+		return func(action k8stesting.Action) (bool, runtime.Object, error) {
+			pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+			pod.Namespace = namespace
+			pod.Status.Phase = phase
+			return false, pod, nil
+		}
+	}
+
+	BeforeEach(func() {
+		uiOut = &strings.Builder{}
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      uiOut,
+			ErrorWriter: io.Discard,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		kubeClient = fakek8sclient.NewSimpleClientset(&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name + "-rootdisk",
+				Namespace: namespace,
+			},
+		})
+
+		step = &iso.StepCustomizeDisk{
+			Config: iso.Config{
+				Name:              name,
+				Namespace:         namespace,
+				NodeSelector:      map[string]string{"kubernetes.io/hostname": "node1"},
+				CustomizeCommands: []string{"virt-sysprep -a $DISK", "virt-sparsify --in-place $DISK"},
+			},
+			Client: kubeClient,
+		}
+	})
+
+	Context("Run", func() {
+		It("runs the commands against the root disk and streams the logs", func() {
+			var created *corev1.Pod
+			kubeClient.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+				return false, nil, nil
+			})
+			kubeClient.PrependReactor("create", "pods", completePod(corev1.PodSucceeded))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(uiOut.String()).To(ContainSubstring("fake logs"))
+
+			Expect(created.Spec.NodeSelector).To(HaveKeyWithValue("kubernetes.io/hostname", "node1"))
+			Expect(created.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal(name + "-rootdisk"))
+
+			container := created.Spec.Containers[0]
+			Expect(container.Command).To(ContainElement("virt-sysprep -a $DISK\nvirt-sparsify --in-place $DISK"))
+			Expect(container.Env).To(ContainElement(corev1.EnvVar{Name: "DISK", Value: "/disk/disk.img"}))
+			Expect(container.VolumeMounts).To(HaveLen(1))
+		})
+
+		It("attaches block volumes as a device", func() {
+			block := corev1.PersistentVolumeBlock
+			claim, err := kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name+"-rootdisk", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			claim.Spec.VolumeMode = &block
+			_, err = kubeClient.CoreV1().PersistentVolumeClaims(namespace).Update(context.Background(), claim, metav1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			kubeClient.PrependReactor("create", "pods", completePod(corev1.PodSucceeded))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			pod, err := kubeClient.CoreV1().Pods(namespace).Get(context.Background(), name+"-customize", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.Containers[0].VolumeDevices).To(ConsistOf(corev1.VolumeDevice{Name: "rootdisk", DevicePath: "/dev/rootdisk"}))
+		})
+
+		It("sparsifies the root disk after the customize commands", func() {
+			step.Config.CustomizeCommands = []string{"virt-sysprep -a $DISK"}
+			step.Config.Sparsify = true
+
+			kubeClient.PrependReactor("create", "pods", completePod(corev1.PodSucceeded))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			pod, err := kubeClient.CoreV1().Pods(namespace).Get(context.Background(), name+"-customize", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.Containers[0].Command).To(ContainElement("virt-sysprep -a $DISK\nvirt-sparsify --in-place $DISK"))
+		})
+
+		It("halts when the Pod fails", func() {
+			kubeClient.PrependReactor("create", "pods", completePod(corev1.PodFailed))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+
+		It("halts when the root disk is not found", func() {
+			step.Config.Name = "missing"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+	})
+
+	Context("Cleanup", func() {
+		It("deletes the Pod", func() {
+			kubeClient.PrependReactor("create", "pods", completePod(corev1.PodSucceeded))
+			step.Run(context.Background(), state)
+
+			step.Cleanup(state)
+			(&iso.StepCreateBuildLease{Config: step.Config, Client: kubeClient}).Cleanup(state)
+
+			_, err := kubeClient.CoreV1().Pods(namespace).Get(context.Background(), name+"-customize", metav1.GetOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
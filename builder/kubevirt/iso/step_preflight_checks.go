@@ -0,0 +1,326 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	templatev1 "github.com/openshift/api/template/v1"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	v1 "kubevirt.io/api/core/v1"
+	instancetypeapi "kubevirt.io/api/instancetype"
+	"kubevirt.io/client-go/kubecli"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
+)
+
+const (
+	defaultStorageClassAnnotation     = "storageclass.kubernetes.io/is-default-class"
+	defaultVirtStorageClassAnnotation = "storageclass.kubevirt.io/is-default-virt-class"
+)
+
+// StepPreflightChecks checks that KubeVirt and CDI are installed, that the objects referenced
+// by the configuration exist, and that the user is allowed to create the resources of the build.
+// All the problems are reported at once, before anything is created.
+type StepPreflightChecks struct {
+	Config Config
+	Client kubecli.KubevirtClient
+}
+
+func (s *StepPreflightChecks) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Running the preflight checks...")
+
+	var errs *packer.MultiError
+	installed := s.checkAPIs()
+	errs = packer.MultiErrorAppend(errs, installed...)
+
+	// The referenced objects cannot be found if KubeVirt or CDI are missing.
+	if len(installed) == 0 {
+		errs = packer.MultiErrorAppend(errs, s.checkReferences(ctx)...)
+	}
+	errs = packer.MultiErrorAppend(errs, s.checkPermissions(ctx)...)
+
+	if errs != nil && len(errs.Errors) > 0 {
+		ui.Error(errs.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *StepPreflightChecks) Cleanup(state multistep.StateBag) {
+	// Left blank intentionally
+}
+
+// checkAPIs checks that the API groups of KubeVirt and CDI are served.
+func (s *StepPreflightChecks) checkAPIs() []error {
+	apis := []struct {
+		name         string
+		groupVersion schema.GroupVersion
+	}{
+		{"KubeVirt", v1.SchemeGroupVersion},
+		{"CDI", cdiv1.SchemeGroupVersion},
+	}
+
+	var errs []error
+	for _, api := range apis {
+		_, err := s.Client.DiscoveryClient().ServerResourcesForGroupVersion(api.groupVersion.String())
+		if errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("%s is not installed: the %s API is not served", api.name, api.groupVersion))
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("failed to discover the %s API: %w", api.groupVersion, err))
+		}
+	}
+	return errs
+}
+
+// checkReferences checks that the objects referenced by the configuration exist.
+func (s *StepPreflightChecks) checkReferences(ctx context.Context) []error {
+	namespace := s.Config.buildNamespace()
+	var errs []error
+
+	check := func(kind, namespace, name string, err error) {
+		if err == nil {
+			return
+		}
+		ref := name
+		if namespace != "" {
+			ref = namespace + "/" + name
+		}
+		if errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("%s (%s) not found", kind, ref))
+			return
+		}
+		errs = append(errs, fmt.Errorf("failed to get %s (%s): %w", kind, ref, err))
+	}
+
+	if name := s.Config.InstanceType; name != "" {
+		if s.Config.InstanceTypeKind == instancetypeapi.SingularResourceName {
+			_, err := s.Client.VirtualMachineInstancetype(namespace).Get(ctx, name, metav1.GetOptions{})
+			check("VirtualMachineInstancetype", namespace, name, err)
+		} else {
+			_, err := s.Client.VirtualMachineClusterInstancetype().Get(ctx, name, metav1.GetOptions{})
+			check("VirtualMachineClusterInstancetype", "", name, err)
+		}
+	}
+
+	if name := s.Config.Preference; name != "" {
+		if s.Config.PreferenceKind == instancetypeapi.SingularPreferenceResourceName {
+			_, err := s.Client.VirtualMachinePreference(namespace).Get(ctx, name, metav1.GetOptions{})
+			check("VirtualMachinePreference", namespace, name, err)
+		} else {
+			_, err := s.Client.VirtualMachineClusterPreference().Get(ctx, name, metav1.GetOptions{})
+			check("VirtualMachineClusterPreference", "", name, err)
+		}
+	}
+
+	for _, n := range s.Config.Networks {
+		if n.Multus == nil {
+			continue
+		}
+		nadNamespace, nadName := namespace, n.Multus.NetworkName
+		if ns, name, ok := strings.Cut(nadName, "/"); ok {
+			nadNamespace, nadName = ns, name
+		}
+		_, err := s.Client.NetworkClient().K8sCniCncfIoV1().NetworkAttachmentDefinitions(nadNamespace).Get(ctx, nadName, metav1.GetOptions{})
+		check("NetworkAttachmentDefinition", nadNamespace, nadName, err)
+	}
+
+	for _, d := range s.Config.Disks {
+		if d.PersistentVolumeClaim != nil {
+			_, err := s.Client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, d.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+			check("PersistentVolumeClaim", namespace, d.PersistentVolumeClaim.ClaimName, err)
+		}
+		if d.Secret != nil {
+			_, err := s.Client.CoreV1().Secrets(namespace).Get(ctx, d.Secret.SecretName, metav1.GetOptions{})
+			check("Secret", namespace, d.Secret.SecretName, err)
+		}
+	}
+
+	if name := s.Config.VirtioClaimName; name != "" && !s.Config.DisableVirtioDrivers {
+		_, err := s.Client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+		check("PersistentVolumeClaim", namespace, name, err)
+	}
+
+	if err := s.checkDefaultStorageClass(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// checkDefaultStorageClass checks that a default StorageClass is set, as the volumes of the build
+// do not set one. It is skipped if the user is not allowed to list the StorageClasses.
+func (s *StepPreflightChecks) checkDefaultStorageClass(ctx context.Context) error {
+	storageClasses, err := s.Client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if errors.IsForbidden(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list the StorageClasses: %w", err)
+	}
+
+	for _, sc := range storageClasses.Items {
+		if sc.Annotations[defaultStorageClassAnnotation] == "true" || sc.Annotations[defaultVirtStorageClassAnnotation] == "true" {
+			return nil
+		}
+	}
+	return fmt.Errorf("no default StorageClass is set, the volumes of the build cannot be provisioned")
+}
+
+// checkPermissions checks that the user is allowed to create the resources of the build,
+// to connect to the temporary VM, and to clone volumes across namespaces.
+func (s *StepPreflightChecks) checkPermissions(ctx context.Context) []error {
+	var errs []error
+	for _, attributes := range s.requiredPermissions() {
+		if err := AuthorizeAccess(ctx, s.Client, attributes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	isoNamespace := s.Config.isoNamespace()
+	buildNamespace := s.Config.buildNamespace()
+	outputNamespace := s.Config.outputNamespace()
+
+	if err := AuthorizeVolumeClone(ctx, s.Client, isoNamespace, buildNamespace); err != nil {
+		errs = append(errs, err)
+	}
+	if err := AuthorizeVolumeClone(ctx, s.Client, buildNamespace, outputNamespace); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// requiredPermissions returns the permissions the build requires, besides cloning volumes.
+func (s *StepPreflightChecks) requiredPermissions() []authorizationv1.ResourceAttributes {
+	buildNamespace := s.Config.buildNamespace()
+	outputNamespace := s.Config.outputNamespace()
+
+	permissions := []authorizationv1.ResourceAttributes{
+		{Namespace: buildNamespace, Verb: "create", Resource: "configmaps"},
+		{Namespace: buildNamespace, Verb: "delete", Resource: "configmaps"},
+		{Namespace: buildNamespace, Verb: "create", Group: v1.SchemeGroupVersion.Group, Resource: "virtualmachines"},
+		{Namespace: buildNamespace, Verb: "update", Group: v1.SubresourceGroupName, Resource: "virtualmachines", Subresource: "stop"},
+		{Namespace: buildNamespace, Verb: "get", Group: v1.SubresourceGroupName, Resource: "virtualmachineinstances", Subresource: "vnc"},
+		{Namespace: buildNamespace, Verb: "create", Group: cdiv1.SchemeGroupVersion.Group, Resource: "datavolumes"},
+		{Namespace: outputNamespace, Verb: "create", Group: cdiv1.SchemeGroupVersion.Group, Resource: "datavolumes"},
+		{Namespace: outputNamespace, Verb: "create", Group: cdiv1.SchemeGroupVersion.Group, Resource: "datasources"},
+		// The published DataVolumes are deleted once cloned, orphaning their PersistentVolumeClaims.
+		{Namespace: outputNamespace, Verb: "delete", Group: cdiv1.SchemeGroupVersion.Group, Resource: "datavolumes"},
+		// The temporary resources are deleted once the build is done.
+		{Namespace: buildNamespace, Verb: "delete", Group: v1.SchemeGroupVersion.Group, Resource: "virtualmachines"},
+		{Namespace: buildNamespace, Verb: "delete", Group: cdiv1.SchemeGroupVersion.Group, Resource: "datavolumes"},
+	}
+
+	// The image of the VirtIO drivers is looked up in the KubeVirt resources of all namespaces.
+	if profile, err := s.Config.osProfile(); err == nil && profile.VirtioDrivers &&
+		s.Config.VirtioContainerImage == "auto" && !s.Config.DisableVirtioDrivers {
+		permissions = append(permissions, authorizationv1.ResourceAttributes{
+			Namespace: metav1.NamespaceAll, Verb: "list", Group: v1.SchemeGroupVersion.Group, Resource: "kubevirts",
+		})
+	}
+
+	if s.Config.Communicator == "ssh" || s.Config.Communicator == "winrm" {
+		// The run strategy of the VM is updated before the guest is shut down.
+		permissions = append(permissions,
+			authorizationv1.ResourceAttributes{
+				Namespace: buildNamespace, Verb: "get", Group: v1.SubresourceGroupName, Resource: "virtualmachineinstances", Subresource: "portforward",
+			},
+			authorizationv1.ResourceAttributes{
+				Namespace: buildNamespace, Verb: "update", Group: v1.SchemeGroupVersion.Group, Resource: "virtualmachines",
+			},
+		)
+	}
+
+	if s.Config.MediaFilesSecret {
+		permissions = append(permissions,
+			authorizationv1.ResourceAttributes{
+				Namespace: buildNamespace, Verb: "create", Resource: "secrets",
+			},
+			authorizationv1.ResourceAttributes{
+				Namespace: buildNamespace, Verb: "delete", Resource: "secrets",
+			},
+		)
+	}
+
+	// The media files are read again when copied, which reports the errors.
+	files, _ := readMedia(s.Config)
+	if uploadMedia(s.Config, files) {
+		permissions = append(permissions, authorizationv1.ResourceAttributes{
+			Namespace: buildNamespace, Verb: "create", Group: uploadv1beta1.SchemeGroupVersion.Group, Resource: "uploadtokenrequests",
+		})
+	}
+
+	if len(s.Config.customizeCommands()) > 0 || s.Config.shrinkDisk() {
+		permissions = append(permissions,
+			authorizationv1.ResourceAttributes{
+				Namespace: buildNamespace, Verb: "create", Resource: "pods",
+			},
+			authorizationv1.ResourceAttributes{
+				Namespace: buildNamespace, Verb: "get", Resource: "pods", Subresource: "log",
+			},
+			authorizationv1.ResourceAttributes{
+				Namespace: buildNamespace, Verb: "delete", Resource: "pods",
+			},
+		)
+	}
+
+	if s.Config.CleanupStaleBuilds {
+		permissions = append(permissions, authorizationv1.ResourceAttributes{
+			Namespace: buildNamespace, Verb: "list", Resource: "configmaps",
+		})
+	}
+
+	if s.Config.force() {
+		// The DataSources are switched to the new volumes, then the previous volumes are deleted.
+		permissions = append(permissions,
+			authorizationv1.ResourceAttributes{
+				Namespace: outputNamespace, Verb: "update", Group: cdiv1.SchemeGroupVersion.Group, Resource: "datasources",
+			},
+			authorizationv1.ResourceAttributes{
+				Namespace: outputNamespace, Verb: "delete", Group: cdiv1.SchemeGroupVersion.Group, Resource: "datavolumes",
+			},
+			authorizationv1.ResourceAttributes{
+				Namespace: outputNamespace, Verb: "delete", Resource: "persistentvolumeclaims",
+			},
+		)
+	}
+
+	if t := s.Config.VirtualMachineTemplate; t != nil && t.Create {
+		group, resource := v1.SchemeGroupVersion.Group, "virtualmachines"
+		if t.Kind == "Template" {
+			group, resource = templatev1.GroupName, "templates"
+		}
+
+		verbs := []string{"create"}
+		if s.Config.force() {
+			verbs = append(verbs, "update")
+		}
+		for _, verb := range verbs {
+			permissions = append(permissions, authorizationv1.ResourceAttributes{
+				Namespace: outputNamespace, Verb: verb, Group: group, Resource: resource,
+			})
+		}
+	}
+
+	// The namespaces may be the same.
+	seen := map[authorizationv1.ResourceAttributes]bool{}
+	unique := permissions[:0]
+	for _, p := range permissions {
+		if !seen[p] {
+			seen[p] = true
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,344 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	nadv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakek8sclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	instancetypev1beta1 "kubevirt.io/api/instancetype/v1beta1"
+	"kubevirt.io/client-go/kubecli"
+	kubevirtfake "kubevirt.io/client-go/kubevirt/fake"
+	fakenadclient "kubevirt.io/client-go/networkattachmentdefinitionclient/fake"
+)
+
+var _ = Describe("StepPreflightChecks", func() {
+	const (
+		name = "test-vm"
+	)
+
+	var (
+		ctrl       *gomock.Controller
+		kubeClient *fakek8sclient.Clientset
+		vmClient   *kubevirtfake.Clientset
+		nadClient  *fakenadclient.Clientset
+		state      *multistep.BasicStateBag
+		step       *iso.StepPreflightChecks
+		uiErr      *strings.Builder
+		reviews    []*authorizationv1.ResourceAttributes
+	)
+
+	// allow answers the access reviews, allowing the reviews matching the given filter only.
+	allow := func(allowed func(attributes *authorizationv1.ResourceAttributes) bool) k8stesting.ReactionFunc {
+		return func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+			attributes := review.Spec.ResourceAttributes
+			reviews = append(reviews, attributes)
+			review.Status.Allowed = allowed(attributes)
+			return true, review, nil
+		}
+	}
+
+	allowAll := func(*authorizationv1.ResourceAttributes) bool { return true }
+
+	// cloneReviews returns the namespaces of the reviewed clone permissions.
+	cloneReviews := func() []string {
+		var namespaces []string
+		for _, r := range reviews {
+			if r.Subresource == "source" {
+				namespaces = append(namespaces, r.Namespace)
+			}
+		}
+		return namespaces
+	}
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+
+		uiErr = &strings.Builder{}
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      io.Discard,
+			ErrorWriter: uiErr,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		reviews = nil
+		kubeClient = fakek8sclient.NewSimpleClientset(&storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "standard",
+				Annotations: map[string]string{"storageclass.kubernetes.io/is-default-class": "true"},
+			},
+		})
+		kubeClient.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+			{GroupVersion: "kubevirt.io/v1"},
+			{GroupVersion: "cdi.kubevirt.io/v1beta1"},
+		}
+		vmClient = kubevirtfake.NewSimpleClientset(
+			&instancetypev1beta1.VirtualMachineClusterInstancetype{ObjectMeta: metav1.ObjectMeta{Name: "u1.medium"}},
+			&instancetypev1beta1.VirtualMachineClusterPreference{ObjectMeta: metav1.ObjectMeta{Name: "fedora"}},
+		)
+		// Created through the client, as the tracker does not guess the resource of the kind.
+		nadClient = fakenadclient.NewSimpleClientset()
+		_, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("packer-builds").Create(context.Background(), &nadv1.NetworkAttachmentDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "vlan10", Namespace: "packer-builds"},
+		}, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
+		kubecli.MockKubevirtClientInstance = kubecli.NewMockKubevirtClient(ctrl)
+		kubecli.MockKubevirtClientInstance.EXPECT().AuthorizationV1().Return(kubeClient.AuthorizationV1()).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().CoreV1().Return(kubeClient.CoreV1()).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().StorageV1().Return(kubeClient.StorageV1()).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().DiscoveryClient().Return(kubeClient.Discovery()).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().NetworkClient().Return(nadClient).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().
+			VirtualMachineClusterInstancetype().
+			Return(vmClient.InstancetypeV1beta1().VirtualMachineClusterInstancetypes()).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().
+			VirtualMachineInstancetype(gomock.Any()).
+			DoAndReturn(func(ns string) any {
+				return vmClient.InstancetypeV1beta1().VirtualMachineInstancetypes(ns)
+			}).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().
+			VirtualMachineClusterPreference().
+			Return(vmClient.InstancetypeV1beta1().VirtualMachineClusterPreferences()).AnyTimes()
+		virtClient, _ := kubecli.GetKubevirtClientFromClientConfig(nil)
+
+		step = &iso.StepPreflightChecks{
+			Config: iso.Config{
+				Name:            name,
+				Namespace:       "default",
+				IsoNamespace:    "os-media",
+				BuildNamespace:  "packer-builds",
+				OutputNamespace: "os-images",
+				InstanceType:    "u1.medium",
+				Preference:      "fedora",
+				Communicator:    "ssh",
+				Networks: []iso.Network{
+					{Name: "default", NetworkSource: iso.NetworkSource{Pod: &iso.PodNetwork{}}},
+					{Name: "vlan", NetworkSource: iso.NetworkSource{Multus: &iso.MultusNetwork{NetworkName: "vlan10"}}},
+				},
+			},
+			Client: virtClient,
+		}
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	Context("Run", func() {
+		It("continues when everything exists and is allowed", func() {
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(uiErr.String()).To(BeEmpty())
+
+			var permissions []string
+			for _, r := range reviews {
+				permissions = append(permissions, fmt.Sprintf("%s %s/%s %s/%s", r.Verb, r.Group, r.Resource, r.Subresource, r.Namespace))
+			}
+			Expect(permissions).To(ContainElements(
+				"create kubevirt.io/virtualmachines /packer-builds",
+				"update kubevirt.io/virtualmachines /packer-builds",
+				"update subresources.kubevirt.io/virtualmachines stop/packer-builds",
+				"create cdi.kubevirt.io/datavolumes /os-images",
+				"create cdi.kubevirt.io/datasources /os-images",
+				"get subresources.kubevirt.io/virtualmachineinstances vnc/packer-builds",
+				"get subresources.kubevirt.io/virtualmachineinstances portforward/packer-builds",
+				"delete /configmaps /packer-builds",
+				"delete cdi.kubevirt.io/datavolumes /os-images",
+				"delete kubevirt.io/virtualmachines /packer-builds",
+				"delete cdi.kubevirt.io/datavolumes /packer-builds",
+			))
+			Expect(permissions).NotTo(ContainElements(
+				"create upload.cdi.kubevirt.io/uploadtokenrequests /packer-builds",
+				"get /pods log/packer-builds",
+				"list /configmaps /packer-builds",
+				"update cdi.kubevirt.io/datasources /os-images",
+				"list kubevirt.io/kubevirts /",
+			))
+			Expect(cloneReviews()).To(Equal([]string{"os-media", "packer-builds"}))
+		})
+
+		It("reviews the permissions required by the enabled options", func() {
+			step.Config.MediaFilesISO = true
+			step.Config.MediaFilesSecret = true
+			step.Config.Sparsify = true
+			step.Config.CleanupStaleBuilds = true
+			step.Config.Force = true
+			step.Config.VirtualMachineTemplate = &iso.VirtualMachineTemplate{Kind: "Template", Create: true}
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			var permissions []string
+			for _, r := range reviews {
+				permissions = append(permissions, fmt.Sprintf("%s %s/%s %s/%s", r.Verb, r.Group, r.Resource, r.Subresource, r.Namespace))
+			}
+			Expect(permissions).To(ContainElements(
+				"create upload.cdi.kubevirt.io/uploadtokenrequests /packer-builds",
+				"create /pods /packer-builds",
+				"get /pods log/packer-builds",
+				"delete /pods /packer-builds",
+				"create /secrets /packer-builds",
+				"delete /secrets /packer-builds",
+				"list /configmaps /packer-builds",
+				"update cdi.kubevirt.io/datasources /os-images",
+				"delete cdi.kubevirt.io/datavolumes /os-images",
+				"delete /persistentvolumeclaims /os-images",
+				"create template.openshift.io/templates /os-images",
+				"update template.openshift.io/templates /os-images",
+			))
+		})
+
+		It("reviews the cluster-wide permission to look up the VirtIO drivers image", func() {
+			step.Config.OperatingSystemType = "windows"
+			step.Config.Communicator = "winrm"
+			step.Config.VirtioContainerImage = "auto"
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(func(attributes *authorizationv1.ResourceAttributes) bool {
+				return attributes.Resource != "kubevirts"
+			}))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring(`the "list" permission on "kubevirts.kubevirt.io" is missing cluster-wide`))
+		})
+
+		It("reviews the Pod permissions to shrink the root disk", func() {
+			step.Config.OutputDiskSize = "minimal"
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			var permissions []string
+			for _, r := range reviews {
+				permissions = append(permissions, fmt.Sprintf("%s %s/%s %s/%s", r.Verb, r.Group, r.Resource, r.Subresource, r.Namespace))
+			}
+			Expect(permissions).To(ContainElements(
+				"create /pods /packer-builds",
+				"get /pods log/packer-builds",
+			))
+		})
+
+		It("reports all the problems at once", func() {
+			step.Config.InstanceType = "u1.missing"
+			step.Config.Networks[1].Multus.NetworkName = "other-ns/vlan20"
+			Expect(kubeClient.StorageV1().StorageClasses().Delete(context.Background(), "standard", metav1.DeleteOptions{})).To(Succeed())
+
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(func(attributes *authorizationv1.ResourceAttributes) bool {
+				return attributes.Subresource != "vnc" && attributes.Resource != "datasources"
+			}))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring("VirtualMachineClusterInstancetype (u1.missing) not found"))
+			Expect(uiErr.String()).To(ContainSubstring("NetworkAttachmentDefinition (other-ns/vlan20) not found"))
+			Expect(uiErr.String()).To(ContainSubstring("no default StorageClass is set"))
+			Expect(uiErr.String()).To(ContainSubstring(`the "get" permission on "virtualmachineinstances/vnc.subresources.kubevirt.io" is missing in namespace "packer-builds"`))
+			Expect(uiErr.String()).To(ContainSubstring(`the "create" permission on "datasources.cdi.kubevirt.io" is missing in namespace "os-images"`))
+		})
+
+		It("looks up namespaced instance types in the build namespace", func() {
+			step.Config.InstanceTypeKind = "virtualmachineinstancetype"
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring("VirtualMachineInstancetype (packer-builds/u1.medium) not found"))
+		})
+
+		It("reports missing KubeVirt and CDI without looking up the references", func() {
+			step.Config.InstanceType = "u1.missing"
+			kubeClient.Discovery().(*fakediscovery.FakeDiscovery).Resources = nil
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring("KubeVirt is not installed"))
+			Expect(uiErr.String()).To(ContainSubstring("CDI is not installed"))
+			Expect(uiErr.String()).NotTo(ContainSubstring("u1.missing"))
+		})
+
+		It("skips the StorageClass check when listing them is forbidden", func() {
+			Expect(kubeClient.StorageV1().StorageClasses().Delete(context.Background(), "standard", metav1.DeleteOptions{})).To(Succeed())
+			kubeClient.PrependReactor("list", "storageclasses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "storage.k8s.io", Resource: "storageclasses"}, "", fmt.Errorf("denied"))
+			})
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+		})
+
+		It("only reviews the port forwarding without a communicator", func() {
+			step.Config.Communicator = "none"
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			for _, r := range reviews {
+				Expect(r.Subresource).NotTo(Equal("portforward"))
+			}
+		})
+
+		It("does not review clones when all resources are in the same namespace", func() {
+			step.Config.IsoNamespace = ""
+			step.Config.BuildNamespace = ""
+			step.Config.OutputNamespace = ""
+			step.Config.Networks = nil
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(allowAll))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(cloneReviews()).To(BeEmpty())
+		})
+
+		It("halts when the ISO clone is not allowed", func() {
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(func(attributes *authorizationv1.ResourceAttributes) bool {
+				return attributes.Subresource != "source" || attributes.Namespace != "os-media"
+			}))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring(`not allowed to clone volumes from namespace "os-media" into "packer-builds"`))
+			Expect(uiErr.String()).To(ContainSubstring(`the "create" permission on "datavolumes/source.cdi.kubevirt.io" is missing in namespace "os-media"`))
+		})
+
+		It("halts when the output clone is not allowed", func() {
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", allow(func(attributes *authorizationv1.ResourceAttributes) bool {
+				return attributes.Subresource != "source" || attributes.Namespace != "packer-builds"
+			}))
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring(`not allowed to clone volumes from namespace "packer-builds" into "os-images"`))
+		})
+	})
+})
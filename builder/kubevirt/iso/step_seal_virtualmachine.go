@@ -0,0 +1,52 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	"kubevirt.io/client-go/kubecli"
+)
+
+type StepSealVirtualMachine struct {
+	Config Config
+	Client kubecli.KubevirtClient
+}
+
+func (s *StepSealVirtualMachine) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	name := s.Config.buildName()
+	namespace := s.Config.buildNamespace()
+
+	comm, ok := state.Get("communicator").(packer.Communicator)
+	if !ok {
+		ui.Error("Sealing the guest requires a communicator.")
+		return multistep.ActionHalt
+	}
+
+	timeout := s.Config.SealTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Minute
+	}
+
+	ui.Sayf("Sealing the guest of the temporary VirtualMachine (%s/%s)...", namespace, name)
+	ui.Sayf("Waiting %s for the guest to shut down...", timeout.String())
+
+	err := ShutdownVirtualMachine(ctx, s.Client, namespace, name, comm, s.Config.remoteCmd(s.Config.sealCommand()), timeout)
+	if err != nil {
+		ui.Errorf("Failed to seal the guest: %s", err)
+		return multistep.ActionHalt
+	}
+
+	state.Put("sealed", true)
+	return multistep.ActionContinue
+}
+
+func (s *StepSealVirtualMachine) Cleanup(state multistep.StateBag) {
+	// Left blank intentionally
+}
@@ -0,0 +1,182 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "kubevirt.io/api/core/v1"
+	kubecli "kubevirt.io/client-go/kubecli"
+	kubevirtfake "kubevirt.io/client-go/kubevirt/fake"
+)
+
+var _ = Describe("StepSealVirtualMachine", func() {
+	const (
+		namespace = "test-ns"
+		name      = "test-vm"
+	)
+
+	var (
+		state      *multistep.BasicStateBag
+		step       *iso.StepSealVirtualMachine
+		vmClient   *kubevirtfake.Clientset
+		virtClient kubecli.KubevirtClient
+		mockCtrl   *gomock.Controller
+		mockVirt   *kubecli.MockKubevirtClient
+	)
+
+	BeforeEach(func() {
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      io.Discard,
+			ErrorWriter: io.Discard,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		mockCtrl = gomock.NewController(GinkgoT())
+		vmClient = kubevirtfake.NewSimpleClientset()
+
+		kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
+		mockVirt = kubecli.NewMockKubevirtClient(mockCtrl)
+		kubecli.MockKubevirtClientInstance = mockVirt
+
+		mockVirt.EXPECT().
+			VirtualMachine(namespace).
+			Return(vmClient.KubevirtV1().VirtualMachines(namespace)).
+			AnyTimes()
+		mockVirt.EXPECT().
+			VirtualMachineInstance(namespace).
+			Return(vmClient.KubevirtV1().VirtualMachineInstances(namespace)).
+			AnyTimes()
+
+		virtClient, _ = kubecli.GetKubevirtClientFromClientConfig(nil)
+
+		_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(),
+			&v1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+				},
+			},
+			metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		step = &iso.StepSealVirtualMachine{
+			Config: iso.Config{
+				Name:                name,
+				Namespace:           namespace,
+				OperatingSystemType: "windows",
+				Seal:                true,
+			},
+			Client: virtClient,
+		}
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("Run", func() {
+		It("runs the seal command of the OS profile and waits for the shutdown", func() {
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCmd.Command).To(ContainSubstring("sysprep.exe /generalize /oobe /shutdown"))
+			Expect(state.Get("sealed")).To(BeTrue())
+
+			vm, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*vm.Spec.RunStrategy).To(Equal(v1.RunStrategyRerunOnFailure))
+		})
+
+		It("halts when the guest does not shut down in time", func() {
+			_, err := vmClient.KubevirtV1().VirtualMachineInstances(namespace).Create(context.Background(),
+				&v1.VirtualMachineInstance{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      name,
+						Namespace: namespace,
+					},
+					Status: v1.VirtualMachineInstanceStatus{Phase: v1.Running},
+				},
+				metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			state.Put("communicator", new(packer.MockCommunicator))
+			step.Config.SealTimeout = 10 * time.Millisecond
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(state.Get("sealed")).To(BeNil())
+		})
+
+		It("passes the SSH password to the sudo of the Linux seal command", func() {
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+			step.Config.OperatingSystemType = "linux"
+			step.Config.SSHPassword = "secret"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCmd.Command).To(HavePrefix("sudo -S -p '' sh -c 'truncate -s 0 /etc/machine-id"))
+			Expect(comm.StartCmd.Command).NotTo(ContainSubstring("secret"))
+			Eventually(func() string { return comm.StartStdin }).Should(Equal("secret\n"))
+		})
+
+		It("runs the FreeBSD seal command with sudo", func() {
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+			step.Config.OperatingSystemType = "freebsd"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCmd.Command).To(Equal("sudo -n sh -c 'rm -f /etc/ssh/ssh_host_* && shutdown -p now'"))
+		})
+
+		It("halts right away when the seal command fails", func() {
+			_, err := vmClient.KubevirtV1().VirtualMachineInstances(namespace).Create(context.Background(),
+				&v1.VirtualMachineInstance{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      name,
+						Namespace: namespace,
+					},
+					Status: v1.VirtualMachineInstanceStatus{Phase: v1.Running},
+				},
+				metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			state.Put("communicator", &packer.MockCommunicator{StartExitStatus: 1})
+			step.Config.OperatingSystemType = "linux"
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			start := time.Now()
+			action := step.Run(ctx, state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+			Expect(state.Get("sealed")).To(BeNil())
+		})
+
+		It("halts without a communicator", func() {
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+	})
+})
@@ -0,0 +1,182 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"kubevirt.io/client-go/kubecli"
+)
+
+// shrinkHeadroom is added after the last partition, for the backup GPT header and the alignment
+// of the partitions in the output disk.
+const shrinkHeadroom = 16 * 1024 * 1024
+
+type StepShrinkDisk struct {
+	Config     Config
+	Client     kubernetes.Interface
+	VirtClient kubecli.KubevirtClient
+}
+
+func (s *StepShrinkDisk) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.buildNamespace()
+	buildName := s.Config.buildName()
+
+	claim, err := s.Client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, diskVolumeName(buildName, "root"), metav1.GetOptions{})
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	partitionsEnd, used, err := s.measure(ctx, state, claim.Spec.VolumeMode)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	size, err := s.outputSize(partitionsEnd, used)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	diskSize := resource.MustParse(s.Config.DiskSize)
+	if size.Cmp(diskSize) >= 0 {
+		ui.Sayf("The partitions of the root disk need %s, which is not smaller than the disk size, skipping the shrink.", size.String())
+		return multistep.ActionContinue
+	}
+
+	outputName := diskVolumeName(buildName, "output")
+	ui.Sayf("Creating a new output disk of %s (%s/%s)...", size.String(), namespace, outputName)
+
+	dv, err := blankVolume(outputName, size.String())
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	lease, _ := state.Get("build_lease").(*corev1.ConfigMap)
+	dv.OwnerReferences = ownerReferences(lease)
+
+	dataVolumes := s.VirtClient.CdiClient().CdiV1beta1().DataVolumes(namespace)
+	if _, err := dataVolumes.Create(ctx, dv, metav1.CreateOptions{}); err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	trackResource(state, trackedResource{
+		Kind:      "DataVolume",
+		Namespace: namespace,
+		Name:      outputName,
+		Delete: func(ctx context.Context) error {
+			return dataVolumes.Delete(ctx, outputName, metav1.DeleteOptions{})
+		},
+	})
+
+	if err := WaitUntilDataVolumeSucceeded(ctx, s.VirtClient, namespace, outputName); err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	outputClaim, err := s.Client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, outputName, metav1.GetOptions{})
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	name := buildName + "-shrink"
+	pod, err := shrinkPod(s.Config, name, claim.Spec.VolumeMode, outputClaim.Spec.VolumeMode)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Sayf("Copying the root disk into the output disk in a new Pod (%s/%s)...", namespace, name)
+
+	pod, err = runPod(ctx, state, s.Client, namespace, pod)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if pod.Status.Phase != corev1.PodSucceeded {
+		ui.Errorf("Shrink Pod (%s/%s) failed, see the logs above.", namespace, name)
+		return multistep.ActionHalt
+	}
+
+	state.Put("output_volume_name", outputName)
+	state.Put("output_disk_size", size.String())
+	return multistep.ActionContinue
+}
+
+func (s *StepShrinkDisk) Cleanup(state multistep.StateBag) {
+	// Left blank intentionally
+}
+
+// measure runs a Pod measuring the root disk, and returns the end of its last partition
+// and the space used by the guest filesystems, in bytes.
+func (s *StepShrinkDisk) measure(ctx context.Context, state multistep.StateBag, volumeMode *corev1.PersistentVolumeMode) (int64, int64, error) {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.buildNamespace()
+	name := s.Config.buildName() + "-measure"
+
+	pod, err := measurePod(s.Config, name, volumeMode)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ui.Sayf("Measuring the root disk in a new Pod (%s/%s)...", namespace, name)
+
+	pod, err = runPod(ctx, state, s.Client, namespace, pod)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if pod.Status.Phase != corev1.PodSucceeded {
+		return 0, 0, fmt.Errorf("measure Pod (%s/%s) failed, see the logs above", namespace, name)
+	}
+
+	var message string
+	if statuses := pod.Status.ContainerStatuses; len(statuses) > 0 && statuses[0].State.Terminated != nil {
+		message = statuses[0].State.Terminated.Message
+	}
+
+	var partitionsEnd, used int64
+	if _, err := fmt.Sscanf(message, "%d %d", &partitionsEnd, &used); err != nil || partitionsEnd <= 0 {
+		return 0, 0, fmt.Errorf("measure Pod (%s/%s) reported an invalid result %q", namespace, name, message)
+	}
+	return partitionsEnd, used, nil
+}
+
+// outputSize returns the size of the output disk, given the end of the last partition
+// and the space used by the guest filesystems.
+func (s *StepShrinkDisk) outputSize(partitionsEnd, used int64) (resource.Quantity, error) {
+	const mebibyte = 1024 * 1024
+	required := (partitionsEnd + shrinkHeadroom + mebibyte - 1) / mebibyte * mebibyte
+	requiredSize := *resource.NewQuantity(required, resource.BinarySI)
+
+	if s.Config.OutputDiskSize == "minimal" {
+		return requiredSize, nil
+	}
+
+	size := resource.MustParse(s.Config.OutputDiskSize)
+	if used > size.Value() {
+		return size, fmt.Errorf("the guest filesystems use %s, more than the output disk size %q",
+			resource.NewQuantity(used, resource.BinarySI).String(), s.Config.OutputDiskSize)
+	}
+	if required > size.Value() {
+		return size, fmt.Errorf("the partitions of the root disk need %s, more than the output disk size %q: "+
+			"the filesystems are not shrunk, make the partitions smaller during the installation",
+			requiredSize.String(), s.Config.OutputDiskSize)
+	}
+	return size, nil
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakek8sclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	fakecdiclient "kubevirt.io/client-go/containerizeddataimporter/fake"
+	"kubevirt.io/client-go/kubecli"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+var _ = Describe("StepShrinkDisk", func() {
+	const (
+		namespace = "test-ns"
+		name      = "test-vm"
+	)
+
+	var (
+		ctrl       *gomock.Controller
+		state      *multistep.BasicStateBag
+		step       *iso.StepShrinkDisk
+		kubeClient *fakek8sclient.Clientset
+		cdiClient  *fakecdiclient.Clientset
+		uiErr      *strings.Builder
+		measured   string
+		phase      corev1.PodPhase
+		pods       map[string]*corev1.Pod
+	)
+
+	// completePods simulates the Pods running to completion with the phase,
+	// the measure Pod reporting the measured sizes.
+	completePods := func() k8stesting.ReactionFunc {
+		return func(action k8stesting.Action) (bool, runtime.Object, error) {
+			pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+			pod.Namespace = namespace
+			pod.Status.Phase = phase
+			if pod.Name == name+"-measure" {
+				pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{Message: measured},
+					},
+				}}
+			}
+			pods[pod.Name] = pod.DeepCopy()
+			return false, pod, nil
+		}
+	}
+
+	BeforeEach(func() {
+		uiErr = &strings.Builder{}
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      io.Discard,
+			ErrorWriter: uiErr,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		// The partitions end at 2Gi, and the filesystems use 1Gi.
+		measured = "2147483648 1073741824\n"
+		phase = corev1.PodSucceeded
+		pods = map[string]*corev1.Pod{}
+
+		kubeClient = fakek8sclient.NewSimpleClientset(&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name + "-rootdisk",
+				Namespace: namespace,
+			},
+		})
+		kubeClient.PrependReactor("create", "pods", completePods())
+
+		cdiClient = fakecdiclient.NewSimpleClientset()
+		cdiClient.PrependReactor("create", "datavolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			dv := action.(k8stesting.CreateAction).GetObject().(*cdiv1beta1.DataVolume)
+			dv.Namespace = namespace
+			dv.Status.Phase = cdiv1beta1.Succeeded
+			_ = kubeClient.Tracker().Add(&corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: dv.Name, Namespace: namespace},
+			})
+			return false, dv, nil
+		})
+
+		ctrl = gomock.NewController(GinkgoT())
+		kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
+		kubecli.MockKubevirtClientInstance = kubecli.NewMockKubevirtClient(ctrl)
+		kubecli.MockKubevirtClientInstance.EXPECT().CdiClient().Return(cdiClient).AnyTimes()
+		virtClient, _ := kubecli.GetKubevirtClientFromClientConfig(nil)
+
+		step = &iso.StepShrinkDisk{
+			Config: iso.Config{
+				Name:           name,
+				Namespace:      namespace,
+				DiskSize:       "64Gi",
+				OutputDiskSize: "minimal",
+			},
+			Client:     kubeClient,
+			VirtClient: virtClient,
+		}
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	Context("Run", func() {
+		It("copies the root disk into an output disk sized after the partitions", func() {
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(state.Get("output_volume_name")).To(Equal(name + "-outputdisk"))
+			Expect(state.Get("output_disk_size")).To(Equal("2064Mi"))
+
+			dv, err := cdiClient.CdiV1beta1().DataVolumes(namespace).Get(context.Background(), name+"-outputdisk", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dv.Spec.Source.Blank).NotTo(BeNil())
+			Expect(dv.Spec.Storage.Resources.Requests.Storage().String()).To(Equal("2064Mi"))
+
+			Expect(pods).To(HaveKey(name + "-measure"))
+			container := pods[name+"-shrink"].Spec.Containers[0]
+			Expect(container.Command).To(ContainElement(ContainSubstring(`virt-resize --format raw --output-format raw "$DISK" "$OUTPUT_DISK"`)))
+			Expect(container.Env).To(ContainElements(
+				corev1.EnvVar{Name: "DISK", Value: "/disk/disk.img"},
+				corev1.EnvVar{Name: "OUTPUT_DISK", Value: "/output/disk.img"},
+			))
+			Expect(pods[name+"-shrink"].Spec.Volumes[1].PersistentVolumeClaim.ClaimName).To(Equal(name + "-outputdisk"))
+		})
+
+		It("copies the root disk into an output disk of the output disk size", func() {
+			step.Config.OutputDiskSize = "10Gi"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(state.Get("output_disk_size")).To(Equal("10Gi"))
+		})
+
+		It("halts when the guest filesystems use more than the output disk size", func() {
+			step.Config.OutputDiskSize = "512Mi"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring(`the guest filesystems use 1Gi, more than the output disk size "512Mi"`))
+		})
+
+		It("halts when the partitions do not fit in the output disk size", func() {
+			step.Config.OutputDiskSize = "2Gi"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring(`the partitions of the root disk need 2064Mi, more than the output disk size "2Gi"`))
+			Expect(pods).NotTo(HaveKey(name + "-shrink"))
+		})
+
+		It("keeps the root disk when the partitions fill it", func() {
+			measured = "68719460352 1073741824"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(state.GetOk("output_volume_name")).Error().To(BeFalse())
+			Expect(pods).NotTo(HaveKey(name + "-shrink"))
+		})
+
+		It("halts when the measure Pod reports an invalid result", func() {
+			measured = ""
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring("reported an invalid result"))
+		})
+
+		It("halts when the Pods fail", func() {
+			phase = corev1.PodFailed
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(uiErr.String()).To(ContainSubstring("measure Pod (test-ns/test-vm-measure) failed"))
+		})
+	})
+})
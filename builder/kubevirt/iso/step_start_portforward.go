@@ -32,8 +32,8 @@ func (s *StepStartPortForward) Run(ctx context.Context, state multistep.StateBag
 	var remotePort int
 
 	ui := state.Get("ui").(packer.Ui)
-	name := s.Config.Name
-	namespace := s.Config.Namespace
+	name := s.Config.buildName()
+	namespace := s.Config.buildNamespace()
 
 	if s.Config.Communicator == "ssh" {
 		ipAddress = s.Config.SSHHost
@@ -5,12 +5,14 @@ package iso
 
 import (
 	"context"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/utils/ptr"
+	"k8s.io/apimachinery/pkg/util/wait"
 
 	v1 "kubevirt.io/api/core/v1"
 	"kubevirt.io/client-go/kubecli"
@@ -23,21 +25,40 @@ type StepStopVirtualMachine struct {
 
 func (s *StepStopVirtualMachine) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	name := s.Config.Name
-	namespace := s.Config.Namespace
+	name := s.Config.buildName()
+	namespace := s.Config.buildNamespace()
+
+	comm, ok := state.Get("communicator").(packer.Communicator)
+	sealed, _ := state.Get("sealed").(bool)
+	if command := s.Config.shutdownCommand(); ok && command != "" && !sealed {
+		timeout := s.Config.ShutdownTimeout
+		if timeout == 0 {
+			timeout = 5 * time.Minute
+		}
+
+		ui.Say("Gracefully shutting down the guest...")
+		ui.Sayf("Waiting %s for the guest to shut down...", timeout.String())
+
+		if err := ShutdownVirtualMachine(ctx, s.Client, namespace, name, comm, s.Config.remoteCmd(command), timeout); err != nil {
+			ui.Errorf("Graceful shutdown failed, forcing the VM to stop: %s", err)
+		}
+	}
+
+	if sealed {
+		ui.Say("The guest has been sealed and shut down.")
+	}
 
 	ui.Sayf("Stopping the temporary VirtualMachine (%s/%s)...", namespace, name)
 
-	vm, err := s.Client.VirtualMachine(namespace).Get(ctx, name, metav1.GetOptions{})
-	if err != nil {
+	// A VM already halted by the guest shutdown is rejected with a conflict.
+	err := s.Client.VirtualMachine(namespace).Stop(ctx, name, &v1.StopOptions{})
+	if err != nil && !errors.IsConflict(err) {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-	vm.Spec.RunStrategy = ptr.To(v1.RunStrategyHalted)
 
-	_, err = s.Client.VirtualMachine(vm.Namespace).Update(ctx, vm, metav1.UpdateOptions{})
-	if err != nil {
-		ui.Error(err.Error())
+	if err := s.waitUntilVirtualMachineStopped(ctx); err != nil {
+		ui.Errorf("VirtualMachine (%s/%s) did not stop: %s", namespace, name, err)
 		return multistep.ActionHalt
 	}
 	return multistep.ActionContinue
@@ -46,3 +67,30 @@ func (s *StepStopVirtualMachine) Run(ctx context.Context, state multistep.StateB
 func (s *StepStopVirtualMachine) Cleanup(state multistep.StateBag) {
 	// Left blank intentionally
 }
+
+// waitUntilVirtualMachineStopped waits until the VMI is gone or final and the VM is reported as
+// stopped, so its disks are no longer written to. The VMI of a guest which shut down by itself is
+// left in the Succeeded phase under the RerunOnFailure run strategy.
+func (s *StepStopVirtualMachine) waitUntilVirtualMachineStopped(ctx context.Context) error {
+	name := s.Config.buildName()
+	namespace := s.Config.buildNamespace()
+
+	pollInterval := 5 * time.Second
+	pollTimeout := 600 * time.Second
+	poller := func(ctx context.Context) (bool, error) {
+		vmi, err := s.Client.VirtualMachineInstance(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err == nil && !vmi.IsFinal() {
+			return false, nil
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		vm, err := s.Client.VirtualMachine(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return vm.Status.PrintableStatus == v1.VirtualMachineStatusStopped, nil
+	}
+	return wait.PollUntilContextTimeout(ctx, pollInterval, pollTimeout, true, poller)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	. "github.com/onsi/ginkgo/v2"
@@ -17,9 +18,11 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
 
 	v1 "kubevirt.io/api/core/v1"
 	kubecli "kubevirt.io/client-go/kubecli"
@@ -39,10 +42,11 @@ var _ = Describe("StepStopVirtualMachine", func() {
 		virtClient kubecli.KubevirtClient
 		mockCtrl   *gomock.Controller
 		mockVirt   *kubecli.MockKubevirtClient
+		uiErr      *strings.Builder
 	)
 
 	BeforeEach(func() {
-		uiErr := &strings.Builder{}
+		uiErr = &strings.Builder{}
 		ui := &packer.BasicUi{
 			Reader:      strings.NewReader(""),
 			Writer:      io.Discard,
@@ -62,6 +66,10 @@ var _ = Describe("StepStopVirtualMachine", func() {
 			VirtualMachine(namespace).
 			Return(vmClient.KubevirtV1().VirtualMachines(namespace)).
 			AnyTimes()
+		mockVirt.EXPECT().
+			VirtualMachineInstance(namespace).
+			Return(vmClient.KubevirtV1().VirtualMachineInstances(namespace)).
+			AnyTimes()
 
 		virtClient, _ = kubecli.GetKubevirtClientFromClientConfig(nil)
 
@@ -78,41 +86,201 @@ var _ = Describe("StepStopVirtualMachine", func() {
 		mockCtrl.Finish()
 	})
 
-	Context("Run", func() {
-		It("continues when VM is retrieved and updated successfully", func() {
-			_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(),
-				&v1.VirtualMachine{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      name,
-						Namespace: namespace,
-					},
+	createVirtualMachine := func() {
+		_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(),
+			&v1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
 				},
-				metav1.CreateOptions{})
+			},
+			metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	createVirtualMachineInstance := func() {
+		_, err := vmClient.KubevirtV1().VirtualMachineInstances(namespace).Create(context.Background(),
+			&v1.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+				},
+				Status: v1.VirtualMachineInstanceStatus{Phase: v1.Running},
+			},
+			metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// stopVirtualMachine simulates the stop subresource, which halts the VM and deletes its VMI.
+	stopVirtualMachine := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "stop" {
+			return false, nil, nil
+		}
+
+		gv := v1.SchemeGroupVersion
+		err := vmClient.Tracker().Delete(gv.WithResource("virtualmachineinstances"), namespace, name)
+		if err != nil && !errors.IsNotFound(err) {
+			return true, nil, err
+		}
+
+		obj, err := vmClient.Tracker().Get(gv.WithResource("virtualmachines"), namespace, name)
+		if err != nil {
+			return true, nil, err
+		}
+		vm := obj.(*v1.VirtualMachine)
+		vm.Spec.RunStrategy = ptr.To(v1.RunStrategyHalted)
+		vm.Status.PrintableStatus = v1.VirtualMachineStatusStopped
+		return true, nil, vmClient.Tracker().Update(gv.WithResource("virtualmachines"), vm, namespace)
+	}
+
+	Context("Run", func() {
+		It("continues when VM is stopped successfully", func() {
+			createVirtualMachine()
+			createVirtualMachineInstance()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", stopVirtualMachine)
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+
+			vm, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
 			Expect(err).NotTo(HaveOccurred())
+			Expect(*vm.Spec.RunStrategy).To(Equal(v1.RunStrategyHalted))
+		})
+
+		It("runs the shutdown command through the communicator", func() {
+			createVirtualMachine()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", stopVirtualMachine)
+
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+			step.Config.ShutdownCommand = "poweroff"
 
 			action := step.Run(context.Background(), state)
 			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCalled).To(BeTrue())
+			Expect(comm.StartCmd.Command).To(Equal("poweroff"))
 		})
 
-		It("halts when VM cannot be retrieved", func() {
+		It("does not run the shutdown command when the guest has been sealed", func() {
+			createVirtualMachine()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", stopVirtualMachine)
+
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+			state.Put("sealed", true)
+
 			action := step.Run(context.Background(), state)
-			Expect(action).To(Equal(multistep.ActionHalt))
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCalled).To(BeFalse())
+		})
+
+		It("stops the VM when the guest does not shut down in time", func() {
+			createVirtualMachine()
+			createVirtualMachineInstance()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", stopVirtualMachine)
+
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+			step.Config.ShutdownTimeout = 10 * time.Millisecond
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCmd.Command).To(Equal("sudo -n shutdown -P now"))
+
+			_, err := vmClient.KubevirtV1().VirtualMachineInstances(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
 		})
 
-		It("halts when VM update fails", func() {
-			_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(),
-				&v1.VirtualMachine{
+		It("passes the SSH password to sudo", func() {
+			createVirtualMachine()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", stopVirtualMachine)
+
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+			step.Config.SSHPassword = "it's secret"
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCmd.Command).To(Equal("sudo -S -p '' shutdown -P now"))
+			Eventually(func() string { return comm.StartStdin }).Should(Equal("it's secret\n"))
+		})
+
+		It("stops the VM right away when the shutdown command fails", func() {
+			createVirtualMachine()
+			createVirtualMachineInstance()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", stopVirtualMachine)
+
+			comm := &packer.MockCommunicator{StartExitStatus: 1}
+			state.Put("communicator", comm)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			start := time.Now()
+			action := step.Run(ctx, state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+			Expect(uiErr.String()).To(ContainSubstring(`command "sudo -n shutdown -P now" exited with status 1`))
+
+			_, err := vmClient.KubevirtV1().VirtualMachineInstances(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("continues when the guest has shut down by itself", func() {
+			createVirtualMachine()
+			_, err := vmClient.KubevirtV1().VirtualMachineInstances(namespace).Create(context.Background(),
+				&v1.VirtualMachineInstance{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      name,
 						Namespace: namespace,
 					},
+					Status: v1.VirtualMachineInstanceStatus{Phase: v1.Succeeded},
 				},
 				metav1.CreateOptions{})
 			Expect(err).NotTo(HaveOccurred())
 
-			// Inject update error
-			vmClient.Fake.PrependReactor("update", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
-				return true, nil, fmt.Errorf("simulated update error")
+			// The VM is halted under RerunOnFailure once its VMI succeeded,
+			// so the stop subresource is rejected.
+			vm, err := vmClient.KubevirtV1().VirtualMachines(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			vm.Spec.RunStrategy = ptr.To(v1.RunStrategyRerunOnFailure)
+			vm.Status.PrintableStatus = v1.VirtualMachineStatusStopped
+			_, err = vmClient.KubevirtV1().VirtualMachines(namespace).Update(context.Background(), vm, metav1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			vmClient.Fake.PrependReactor("put", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() != "stop" {
+					return false, nil, nil
+				}
+				return true, nil, errors.NewConflict(v1.Resource("virtualmachines"), name, fmt.Errorf("VM is not running"))
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			action := step.Run(ctx, state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(uiErr.String()).To(BeEmpty())
+		})
+
+		It("halts when the VM does not stop", func() {
+			createVirtualMachine()
+			createVirtualMachineInstance()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, nil
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			action := step.Run(ctx, state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+
+		It("halts when VM cannot be stopped", func() {
+			createVirtualMachine()
+			vmClient.Fake.PrependReactor("put", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, fmt.Errorf("simulated stop error")
 			})
 
 			action := step.Run(context.Background(), state)
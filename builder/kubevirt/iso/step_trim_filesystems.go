@@ -0,0 +1,40 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type StepTrimFilesystems struct {
+	Config Config
+}
+
+func (s *StepTrimFilesystems) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	comm, ok := state.Get("communicator").(packer.Communicator)
+	if !ok {
+		ui.Error("Trimming the guest filesystems requires a communicator.")
+		return multistep.ActionHalt
+	}
+
+	ui.Say("Discarding the unused blocks of the guest filesystems...")
+
+	// The image is still usable if the filesystems could not be trimmed, only larger.
+	cmd := s.Config.remoteCmd(s.Config.trimCommand())
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		ui.Errorf("Failed to trim the guest filesystems: %s", err)
+	} else if status := cmd.ExitStatus(); status != 0 {
+		ui.Errorf("Failed to trim the guest filesystems: command %q exited with status %d", cmd.Command, status)
+	}
+	return multistep.ActionContinue
+}
+
+func (s *StepTrimFilesystems) Cleanup(state multistep.StateBag) {
+	// Left blank intentionally
+}
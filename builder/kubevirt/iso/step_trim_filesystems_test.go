@@ -0,0 +1,82 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+var _ = Describe("StepTrimFilesystems", func() {
+	var (
+		state *multistep.BasicStateBag
+		step  *iso.StepTrimFilesystems
+		uiErr *strings.Builder
+	)
+
+	BeforeEach(func() {
+		uiErr = &strings.Builder{}
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      io.Discard,
+			ErrorWriter: uiErr,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		step = &iso.StepTrimFilesystems{
+			Config: iso.Config{
+				Name:                "test-vm",
+				Namespace:           "test-ns",
+				OperatingSystemType: "linux",
+				Fstrim:              true,
+			},
+		}
+	})
+
+	Context("Run", func() {
+		It("runs the trim command of the OS profile", func() {
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCmd.Command).To(Equal("sudo -n fstrim --all --verbose"))
+			Expect(uiErr.String()).To(BeEmpty())
+		})
+
+		It("passes the SSH password to sudo", func() {
+			step.Config.SSHPassword = "secret"
+			comm := new(packer.MockCommunicator)
+			state.Put("communicator", comm)
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(comm.StartCmd.Command).To(Equal("sudo -S -p '' fstrim --all --verbose"))
+			Eventually(func() string { return comm.StartStdin }).Should(Equal("secret\n"))
+		})
+
+		It("continues when the trim command fails", func() {
+			comm := &packer.MockCommunicator{StartExitStatus: 1}
+			state.Put("communicator", comm)
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(uiErr.String()).To(ContainSubstring("Failed to trim the guest filesystems"))
+		})
+
+		It("halts without a communicator", func() {
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionHalt))
+		})
+	})
+})
@@ -20,7 +20,7 @@ type StepValidateIsoDataVolume struct {
 
 func (s *StepValidateIsoDataVolume) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	isoVolumeNamespace := s.Config.Namespace
+	isoVolumeNamespace := s.Config.isoNamespace()
 	isoVolumeName := s.Config.IsoVolumeName
 
 	ui.Sayf("Validating the existence of the ISO DataVolume (%s/%s)...", isoVolumeNamespace, isoVolumeName)
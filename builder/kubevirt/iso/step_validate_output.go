@@ -0,0 +1,140 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	templatev1 "github.com/openshift/api/template/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kubevirt.io/client-go/kubecli"
+)
+
+// StepValidateOutput checks whether the published image already exists before anything is built,
+// which fails the build unless the image is to be replaced with force.
+type StepValidateOutput struct {
+	Config Config
+	Client kubecli.KubevirtClient
+}
+
+func (s *StepValidateOutput) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	namespace := s.Config.outputNamespace()
+
+	outputs, err := s.existingOutputs(ctx)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	for _, output := range outputs {
+		if !s.Config.force() {
+			ui.Errorf("%s (%s/%s) already exists, set force or use -force to replace it.", output.kind, namespace, output.name)
+			return multistep.ActionHalt
+		}
+		ui.Sayf("%s (%s/%s) already exists and will be replaced.", output.kind, namespace, output.name)
+	}
+	return multistep.ActionContinue
+}
+
+func (s *StepValidateOutput) Cleanup(state multistep.StateBag) {
+	// Left blank intentionally
+}
+
+// existingResource is an existing resource of the published image.
+type existingResource struct {
+	kind string
+	name string
+}
+
+// existingOutputs returns the existing resources of the published volumes,
+// and the VirtualMachine or Template created from the image.
+func (s *StepValidateOutput) existingOutputs(ctx context.Context) ([]existingResource, error) {
+	var outputs []existingResource
+	for _, name := range s.Config.outputNames() {
+		kind, err := s.existingOutput(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if kind != "" {
+			outputs = append(outputs, existingResource{kind: kind, name: name})
+		}
+	}
+
+	if t := s.Config.VirtualMachineTemplate; t != nil && t.Create {
+		kind, err := s.existingTemplate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if kind != "" {
+			outputs = append(outputs, existingResource{kind: kind, name: s.Config.templateName()})
+		}
+	}
+	return outputs, nil
+}
+
+// existingOutput returns the kind of the first existing resource of a published volume, if any.
+func (s *StepValidateOutput) existingOutput(ctx context.Context, name string) (string, error) {
+	namespace := s.Config.outputNamespace()
+
+	checks := []struct {
+		kind string
+		get  func() error
+	}{
+		{"DataSource", func() error {
+			_, err := s.Client.CdiClient().CdiV1beta1().DataSources(namespace).Get(ctx, name, metav1.GetOptions{})
+			return err
+		}},
+		{"DataVolume", func() error {
+			_, err := s.Client.CdiClient().CdiV1beta1().DataVolumes(namespace).Get(ctx, name, metav1.GetOptions{})
+			return err
+		}},
+		{"PersistentVolumeClaim", func() error {
+			_, err := s.Client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+			return err
+		}},
+	}
+
+	for _, check := range checks {
+		err := check.get()
+		if err == nil {
+			return check.kind, nil
+		}
+		if !errors.IsNotFound(err) {
+			return "", fmt.Errorf("failed to check the existing %s (%s/%s): %w", check.kind, namespace, name, err)
+		}
+	}
+	return "", nil
+}
+
+// existingTemplate returns the kind of the VirtualMachine or Template created from the image,
+// if it exists.
+func (s *StepValidateOutput) existingTemplate(ctx context.Context) (string, error) {
+	namespace := s.Config.outputNamespace()
+	name := s.Config.templateName()
+
+	var err error
+	kind := s.Config.VirtualMachineTemplate.Kind
+	if kind == "Template" {
+		resource := templatev1.GroupVersion.WithResource("templates")
+		_, err = s.Client.DynamicClient().Resource(resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	} else {
+		kind = "VirtualMachine"
+		_, err = s.Client.VirtualMachine(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	if errors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check the existing %s (%s/%s): %w", kind, namespace, name, err)
+	}
+	return kind, nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Red Hat, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package iso_test
+
+import (
+	"context"
+	"strings"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/hashicorp/packer-plugin-kubevirt/builder/kubevirt/iso"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+
+	templatev1 "github.com/openshift/api/template/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	fakek8sclient "k8s.io/client-go/kubernetes/fake"
+
+	v1 "kubevirt.io/api/core/v1"
+	fakecdiclient "kubevirt.io/client-go/containerizeddataimporter/fake"
+	"kubevirt.io/client-go/kubecli"
+	kubevirtfake "kubevirt.io/client-go/kubevirt/fake"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+var _ = Describe("StepValidateOutput", func() {
+	const (
+		namespace = "os-images"
+		name      = "fedora"
+	)
+
+	var (
+		ctrl       *gomock.Controller
+		cdiClient  *fakecdiclient.Clientset
+		kubeClient *fakek8sclient.Clientset
+		vmClient   *kubevirtfake.Clientset
+		state      *multistep.BasicStateBag
+		step       *iso.StepValidateOutput
+		uiOut      *strings.Builder
+		uiErr      *strings.Builder
+	)
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+
+		uiOut = &strings.Builder{}
+		uiErr = &strings.Builder{}
+		ui := &packer.BasicUi{
+			Reader:      strings.NewReader(""),
+			Writer:      uiOut,
+			ErrorWriter: uiErr,
+		}
+		state = new(multistep.BasicStateBag)
+		state.Put("ui", ui)
+
+		cdiClient = fakecdiclient.NewSimpleClientset()
+		kubeClient = fakek8sclient.NewSimpleClientset()
+		vmClient = kubevirtfake.NewSimpleClientset()
+
+		kubecli.GetKubevirtClientFromClientConfig = kubecli.GetMockKubevirtClientFromClientConfig
+		kubecli.MockKubevirtClientInstance = kubecli.NewMockKubevirtClient(ctrl)
+		kubecli.MockKubevirtClientInstance.EXPECT().CdiClient().Return(cdiClient).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().CoreV1().Return(kubeClient.CoreV1()).AnyTimes()
+		kubecli.MockKubevirtClientInstance.EXPECT().
+			VirtualMachine(gomock.Any()).
+			DoAndReturn(func(ns string) kubecli.VirtualMachineInterface {
+				return vmClient.KubevirtV1().VirtualMachines(ns)
+			}).AnyTimes()
+		virtClient, _ := kubecli.GetKubevirtClientFromClientConfig(nil)
+
+		step = &iso.StepValidateOutput{
+			Config: iso.Config{
+				Name:      name,
+				Namespace: namespace,
+				Disks: []iso.Disk{
+					{Name: "data", Output: true, VolumeSource: iso.VolumeSource{Blank: &iso.BlankVolume{Size: "10Gi"}}},
+					{Name: "scratch", VolumeSource: iso.VolumeSource{Blank: &iso.BlankVolume{Size: "1Gi"}}},
+				},
+			},
+			Client: virtClient,
+		}
+	})
+
+	It("continues when nothing is published yet", func() {
+		action := step.Run(context.Background(), state)
+		Expect(action).To(Equal(multistep.ActionContinue))
+		Expect(uiErr.String()).To(BeEmpty())
+	})
+
+	It("halts when the DataSource already exists", func() {
+		_, err := cdiClient.CdiV1beta1().DataSources(namespace).Create(context.Background(), &cdiv1beta1.DataSource{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		}, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		action := step.Run(context.Background(), state)
+		Expect(action).To(Equal(multistep.ActionHalt))
+		Expect(uiErr.String()).To(ContainSubstring("DataSource (os-images/fedora) already exists"))
+	})
+
+	It("halts when the volume of an exported disk is left over", func() {
+		_, err := kubeClient.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-data", Namespace: namespace},
+		}, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		action := step.Run(context.Background(), state)
+		Expect(action).To(Equal(multistep.ActionHalt))
+		Expect(uiErr.String()).To(ContainSubstring("PersistentVolumeClaim (os-images/fedora-data) already exists"))
+	})
+
+	It("ignores disks that are not exported", func() {
+		_, err := cdiClient.CdiV1beta1().DataVolumes(namespace).Create(context.Background(), &cdiv1beta1.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-scratch", Namespace: namespace},
+		}, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		action := step.Run(context.Background(), state)
+		Expect(action).To(Equal(multistep.ActionContinue))
+	})
+
+	It("halts when the VirtualMachine of vm_template already exists", func() {
+		step.Config.VirtualMachineTemplate = &iso.VirtualMachineTemplate{Name: "fedora-vm", Create: true}
+		_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(), &v1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "fedora-vm", Namespace: namespace},
+		}, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		action := step.Run(context.Background(), state)
+		Expect(action).To(Equal(multistep.ActionHalt))
+		Expect(uiErr.String()).To(ContainSubstring("VirtualMachine (os-images/fedora-vm) already exists"))
+	})
+
+	It("halts when the Template of vm_template already exists", func() {
+		step.Config.VirtualMachineTemplate = &iso.VirtualMachineTemplate{Kind: "Template", Create: true}
+		template := &unstructured.Unstructured{}
+		template.SetGroupVersionKind(templatev1.GroupVersion.WithKind("Template"))
+		template.SetNamespace(namespace)
+		template.SetName(name)
+		dynamicClient := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), template)
+		kubecli.MockKubevirtClientInstance.EXPECT().DynamicClient().Return(dynamicClient).AnyTimes()
+
+		action := step.Run(context.Background(), state)
+		Expect(action).To(Equal(multistep.ActionHalt))
+		Expect(uiErr.String()).To(ContainSubstring("Template (os-images/fedora) already exists"))
+	})
+
+	It("ignores an existing VirtualMachine if vm_template does not create it", func() {
+		step.Config.VirtualMachineTemplate = &iso.VirtualMachineTemplate{Path: "vm.yaml"}
+		_, err := vmClient.KubevirtV1().VirtualMachines(namespace).Create(context.Background(), &v1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		}, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		action := step.Run(context.Background(), state)
+		Expect(action).To(Equal(multistep.ActionContinue))
+	})
+
+	Context("with force", func() {
+		BeforeEach(func() {
+			_, err := cdiClient.CdiV1beta1().DataSources(namespace).Create(context.Background(), &cdiv1beta1.DataSource{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("continues when force is set", func() {
+			step.Config.Force = true
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+			Expect(uiOut.String()).To(ContainSubstring("will be replaced"))
+		})
+
+		It("continues when -force is set", func() {
+			step.Config.PackerForce = true
+
+			action := step.Run(context.Background(), state)
+			Expect(action).To(Equal(multistep.ActionContinue))
+		})
+	})
+})